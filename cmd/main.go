@@ -2,20 +2,26 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 	"xdcc-cli/cmd/output"
 	"xdcc-cli/proxy"
 	"xdcc-cli/search"
 	table "xdcc-cli/table"
+	"xdcc-cli/util"
 	xdcc "xdcc-cli/xdcc"
 )
 
@@ -82,11 +88,23 @@ func outputSearchResultsJSON(results []search.XdccFileInfo) {
 	fmt.Println(string(jsonBytes))
 }
 
+// outputSearchResultsList prints the url and the size of each result, a
+// list the get command reads with -i to check the size of the offers.
+func outputSearchResultsList(results []search.XdccFileInfo) {
+	for _, fileInfo := range results {
+		if fileInfo.Size > 0 {
+			fmt.Println(fileInfo.URL.String(), formatSize(fileInfo.Size))
+		} else {
+			fmt.Println(fileInfo.URL.String())
+		}
+	}
+}
+
 func execSearch(args []string) {
 	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
 	sortByFilename := searchCmd.Bool("s", false, "sort results by filename")
 	proxyURL := searchCmd.String("proxy", "", "SOCKS5 proxy URL (e.g., socks5://localhost:1080)")
-	format := searchCmd.String("format", "table", "output format (table, json)")
+	format := searchCmd.String("format", "table", "output format (table, json, list)")
 
 	args = parseFlags(searchCmd, args)
 
@@ -103,9 +121,13 @@ func execSearch(args []string) {
 	res, _ := searchEngine.Search(args)
 
 	// Handle output format
-	if *format == "json" {
+	switch *format {
+	case "json":
 		outputSearchResultsJSON(res)
 		return
+	case "list":
+		outputSearchResultsList(res)
+		return
 	}
 
 	// Table output (default)
@@ -139,10 +161,19 @@ func transferLoop(transfer xdcc.Transfer, formatter output.TransferOutputFormatt
 		case *xdcc.TransferConnectedEvent:
 			formatter.OnConnected(evt)
 
+		case *xdcc.TransferWaitingEvent:
+			formatter.OnWaiting(evt)
+
+		case *xdcc.TransferQueuedEvent:
+			formatter.OnQueued(evt)
+
 		case *xdcc.TransferStartedEvent:
 			totalBytes = evt.FileSize
 			formatter.OnStarted(evt)
 
+		case *xdcc.TransferResumedEvent:
+			formatter.OnResumed(evt)
+
 		case *xdcc.TransferProgessEvent:
 			formatter.OnProgress(evt, totalBytes)
 
@@ -150,6 +181,10 @@ func transferLoop(transfer xdcc.Transfer, formatter output.TransferOutputFormatt
 			formatter.OnCompleted(evt)
 			return true
 
+		case *xdcc.TransferSkippedEvent:
+			formatter.OnSkipped(evt)
+			return true
+
 		case *xdcc.TransferErrorEvent:
 			formatter.OnError(evt)
 
@@ -164,11 +199,21 @@ func transferLoop(transfer xdcc.Transfer, formatter output.TransferOutputFormatt
 }
 
 func suggestUnknownAuthoritySwitch(err error) {
-	if err.Error() == (x509.UnknownAuthorityError{}.Error()) {
-		fmt.Println("use the --allow-unknown-authority flag to skip certificate verification")
+	var unknownAuth x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuth) {
+		fmt.Println("use --tls-policy allow-unknown-authority (or tofu) to accept the certificate of this server")
 	}
 }
 
+// startErrorType returns the category of an error returned by Start.
+func startErrorType(err error) xdcc.ErrorType {
+	var transferErr *xdcc.TransferError
+	if errors.As(err, &transferErr) {
+		return transferErr.Type
+	}
+	return xdcc.ErrorTypeNetwork
+}
+
 func doTransfer(transfer xdcc.Transfer, format string, urlStr string) bool {
 	// Create the appropriate formatter based on format
 	var formatter output.TransferOutputFormatter
@@ -199,7 +244,7 @@ func doTransfer(transfer xdcc.Transfer, format string, urlStr string) bool {
 			jsonlFormatter.OnError(&xdcc.TransferErrorEvent{
 				URL:       urlStr,
 				Error:     err.Error(),
-				ErrorType: "network",
+				ErrorType: string(startErrorType(err)),
 				Fatal:     true,
 			})
 			return false
@@ -260,12 +305,79 @@ func loadUrlListFile(filePath string) []string {
 	return urlList
 }
 
+// splitExpectedSize splits an entry of the url list into the url and the
+// size advertised for the pack, as in "irc://... 700MB". The size is zero
+// when not given.
+func splitExpectedSize(entry string) (string, int64) {
+	fields := strings.Fields(entry)
+	if len(fields) != 2 {
+		return entry, 0
+	}
+	size, err := util.ParseByteSize(fields[1])
+	if err != nil {
+		return entry, 0
+	}
+	return fields[0], size
+}
+
+// joinCommandArgs joins the words of the "/msg Bot xdcc send #42" commands
+// given unquoted on the command line, each command runs until the next
+// URL or command.
+func joinCommandArgs(args []string) []string {
+	isEntryStart := func(arg string) bool {
+		for _, prefix := range []string{"irc://", "ircs://", "/msg", "/ctcp"} {
+			if strings.HasPrefix(strings.ToLower(arg), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	joined := make([]string, 0, len(args))
+	inCommand := false
+	for _, arg := range args {
+		if inCommand && !isEntryStart(arg) {
+			joined[len(joined)-1] += " " + arg
+			continue
+		}
+		inCommand = strings.HasPrefix(arg, "/")
+		joined = append(joined, arg)
+	}
+	return joined
+}
+
 func printGetUsageAndExit(flagSet *flag.FlagSet) {
-	fmt.Printf("usage: get url1 url2 ... [-o path] [-i file] [--ssl-only] [--proxy url]\n\nFlag set:\n")
+	fmt.Printf("usage: get url1 url2 ... [-o path] [-i file] [--ssl-only] [--tls-policy policy] [--proxy url]\n\nFlag set:\n")
 	flagSet.PrintDefaults()
 	os.Exit(0)
 }
 
+// cancelTimeout bounds how long we wait for transfers to shut down on interrupt
+const cancelTimeout = 5 * time.Second
+
+// cancelOnInterrupt cancels all transfers on the first SIGINT/SIGTERM.
+// A second signal terminates the process right away.
+func cancelOnInterrupt(transfers []xdcc.Transfer) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+
+		cancelCtx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+		defer cancel()
+
+		wg := sync.WaitGroup{}
+		for _, transfer := range transfers {
+			wg.Add(1)
+			go func(transfer xdcc.Transfer) {
+				transfer.Cancel(cancelCtx)
+				wg.Done()
+			}(transfer)
+		}
+		wg.Wait()
+	}()
+}
+
 // emitJSONLEvent is a helper to emit standalone JSONL events (for errors and finished events)
 func emitJSONLEvent(event output.JSONLEvent) {
 	formatter := output.NewJSONLFormatter("")
@@ -278,17 +390,169 @@ func execGet(args []string) {
 	inputFile := getCmd.String("i", "", "input file containing a list of urls")
 	proxyURL := getCmd.String("proxy", "", "SOCKS5 proxy URL (e.g., socks5://localhost:1080)")
 	format := getCmd.String("format", "cli", "output format (cli, jsonl)")
-	sanitizeFilenames := getCmd.Bool("sanitize-filenames", false, "sanitize filenames to ASCII-only safe characters")
+	onExists := getCmd.String("on-exists", string(xdcc.ExistsRename), "what to do when the file already exists (skip, overwrite, rename, resume)")
+	filenameStyle := getCmd.String("filename-policy", string(xdcc.FilenameUnicodePreserving), "characters kept in the names of files (unicode-preserving, posix-safe, windows-safe, ascii-only)")
+	maxFilenameBytes := getCmd.Int("max-filename-bytes", xdcc.DefaultMaxFilenameBytes, "longest file name in bytes, longer names are shortened")
+	sanitizeFilenames := getCmd.Bool("sanitize-filenames", false, "same as --filename-policy ascii-only (deprecated)")
 
 	sslOnly := getCmd.Bool("ssl-only", false, "force the client to use TSL connection")
-
-	urlList := parseFlags(getCmd, args)
+	dccIP := getCmd.String("dcc-ip", "", "external IP address advertised to bots for passive DCC")
+	dccAck := getCmd.String("dcc-ack", "auto", "DCC acknowledgement mode (auto, none, 32, 64)")
+	connectTimeout := getCmd.Duration("connect-timeout", xdcc.DefaultTimeouts.Connect, "time allowed to connect to the network (0 to wait forever)")
+	joinTimeout := getCmd.Duration("join-timeout", xdcc.DefaultTimeouts.Join, "time allowed to join the channel (0 to wait forever)")
+	offerTimeout := getCmd.Duration("offer-timeout", xdcc.DefaultTimeouts.Offer, "time allowed for the bot to send the file (0 to wait forever)")
+	queueTimeout := getCmd.Duration("queue-timeout", xdcc.DefaultTimeouts.Queued, "time allowed to wait in the bot queue (0 to wait forever)")
+	stallTimeout := getCmd.Duration("stall-timeout", xdcc.DefaultStallPolicy.Timeout, "restart the download when no data is received for this long (0 to disable)")
+	minSpeed := getCmd.String("min-speed", "0", "restart the download when slower than this many bytes/s (e.g., 10K)")
+	limitRate := getCmd.String("limit-rate", "0", "maximum download speed of each transfer in bytes/s (e.g., 500K, 0 for no limit)")
+	globalLimitRate := getCmd.String("global-limit-rate", "0", "maximum total download speed of all transfers in bytes/s (e.g., 2M, 0 for no limit)")
+	minSpeedPeriod := getCmd.Duration("min-speed-period", xdcc.DefaultStallPolicy.MinSpeedPeriod, "period over which --min-speed is measured")
+	retryMax := getCmd.Int("retry-max", xdcc.DefaultRetryPolicy.MaxAttempts, "maximum number of attempts to connect or download, including the first one")
+	retryBackoff := getCmd.Duration("retry-backoff", xdcc.DefaultRetryPolicy.InitialBackoff, "delay before the first retry, doubled after each retry")
+	retryMaxBackoff := getCmd.Duration("retry-max-backoff", xdcc.DefaultRetryPolicy.MaxBackoff, "maximum delay between retries")
+	retryJitter := getCmd.Float64("retry-jitter", xdcc.DefaultRetryPolicy.Jitter, "fraction by which retry delays are randomized (0 to disable)")
+	tlsPolicy := getCmd.String("tls-policy", string(xdcc.TLSStrict), "server certificates to accept (strict, allow-unknown-authority, tofu, plaintext-allowed)")
+	tlsModes := getCmd.String("tls-modes", "", "ordered list of connection modes to try (tls, tls-insecure, plain), the last two need --tls-policy plaintext-allowed (default tls, then plain with plaintext-allowed)")
+	caFile := getCmd.String("ca-file", "", "PEM file of additional certificate authorities to trust")
+	authFile := getCmd.String("auth-file", "", "file of per-network credentials (SASL or NickServ)")
+	knownHosts := getCmd.String("known-hosts", xdcc.DefaultKnownHostsPath(), "file of certificates pinned by --tls-policy tofu")
+	maxActive := getCmd.Int("max-active", 0, "maximum number of simultaneous downloads (0 for no limit)")
+	maxPerNetwork := getCmd.Int("max-per-network", 0, "maximum number of simultaneous downloads per network (0 for no limit)")
+	maxPerBot := getCmd.Int("max-per-bot", xdcc.DefaultLimits.PerBot, "maximum number of simultaneous downloads per bot (0 for no limit)")
+	xdccInfo := getCmd.Bool("xdcc-info", false, "ask the bot for the hashes of the pack to verify the download")
+	failOnMismatch := getCmd.Bool("fail-on-mismatch", false, "fail the transfer when the file does not match its checksum")
+	maxSize := getCmd.String("max-size", "0", "refuse files larger than this (e.g., 4G, 0 for no limit)")
+	maxSizeDeviation := getCmd.Float64("max-size-deviation", 0.1, "refuse files whose size differs from the size given in the input file or search result row by more than this fraction (0 to disable)")
+	preallocate := getCmd.Bool("preallocate", false, "reserve the disk space of files before downloading them")
+	dccPorts := getCmd.String("dcc-ports", "", "port or port range to listen on for passive DCC (e.g., 49152-49200)")
+	nick := getCmd.String("nick", xdcc.DefaultIdentity.Nick, "nickname, "+xdcc.NickRandPlaceholder+" is replaced by random digits")
+	ident := getCmd.String("ident", xdcc.DefaultIdentity.Ident, "user name shown in the hostmask")
+	realName := getCmd.String("realname", xdcc.DefaultIdentity.RealName, "real name shown by WHOIS")
+	ctcpVersion := getCmd.String("ctcp-version", xdcc.DefaultIdentity.Version, "reply to CTCP VERSION queries")
+	network := getCmd.String("network", "", "network of the bots named by \"/msg Bot xdcc send #N\" inputs, when not in --bots")
+	channel := getCmd.String("channel", "", "channel of the bots named by \"/msg Bot xdcc send #N\" inputs, when not in --bots")
+	botsFile := getCmd.String("bots", "", "file of the network and channel of bots, one \"bot network channel\" per line")
+
+	urlList := joinCommandArgs(parseFlags(getCmd, args))
 
 	// Initialize proxy
 	if err := proxy.Initialize(*proxyURL); err != nil {
 		log.Fatalf("Failed to initialize proxy: %v\n", err)
 	}
 
+	if *nick == "" || strings.ContainsAny(*nick, " \t") {
+		log.Fatalf("--nick: invalid nickname %q\n", *nick)
+	}
+	if *ident == "" || strings.ContainsAny(*ident, " \t@") {
+		log.Fatalf("--ident: invalid user name %q\n", *ident)
+	}
+	identity := xdcc.Identity{
+		Nick:     *nick,
+		Ident:    *ident,
+		RealName: *realName,
+		Version:  *ctcpVersion,
+	}
+
+	passivePorts, err := xdcc.ParsePortRange(*dccPorts)
+	if err != nil {
+		log.Fatalf("--dcc-ports: %v\n", err)
+	}
+
+	ackMode, err := xdcc.ParseAckMode(*dccAck)
+	if err != nil {
+		log.Fatalf("--dcc-ack: %v\n", err)
+	}
+
+	minSpeedBytes, err := util.ParseByteSize(*minSpeed)
+	if err != nil {
+		log.Fatalf("--min-speed: %v\n", err)
+	}
+
+	limitRateBytes, err := util.ParseByteSize(*limitRate)
+	if err != nil {
+		log.Fatalf("--limit-rate: %v\n", err)
+	}
+
+	globalLimitRateBytes, err := util.ParseByteSize(*globalLimitRate)
+	if err != nil {
+		log.Fatalf("--global-limit-rate: %v\n", err)
+	}
+
+	maxSizeBytes, err := util.ParseByteSize(*maxSize)
+	if err != nil {
+		log.Fatalf("--max-size: %v\n", err)
+	}
+
+	style, err := xdcc.ParseFilenameStyle(*filenameStyle)
+	if err != nil {
+		log.Fatalf("--filename-policy: %v\n", err)
+	}
+	if *sanitizeFilenames {
+		style = xdcc.FilenameASCIIOnly
+	}
+	filenamePolicy := xdcc.StandardFilenamePolicy{Style: style, MaxBytes: *maxFilenameBytes}
+
+	existsPolicy, err := xdcc.ParseExistsPolicy(*onExists)
+	if err != nil {
+		log.Fatalf("--on-exists: %v\n", err)
+	}
+
+	tlsSecurity, err := xdcc.ParseTLSSecurity(*tlsPolicy)
+	if err != nil {
+		log.Fatalf("--tls-policy: %v\n", err)
+	}
+
+	tlsConfig := xdcc.TLSPolicy{Security: tlsSecurity}
+
+	var tlsModeList []xdcc.TLSMode
+	if *tlsModes != "" {
+		if tlsModeList, err = xdcc.ParseTLSModes(*tlsModes); err == nil {
+			err = tlsConfig.CheckModes(tlsModeList)
+		}
+		if err != nil {
+			log.Fatalf("--tls-modes: %v\n", err)
+		}
+	}
+	if *caFile != "" {
+		if tlsConfig.RootCAs, err = xdcc.LoadCABundle(*caFile); err != nil {
+			log.Fatalf("--ca-file: %v\n", err)
+		}
+	}
+	if tlsSecurity == xdcc.TLSTrustOnFirstUse {
+		if tlsConfig.KnownHosts, err = xdcc.LoadKnownHosts(*knownHosts); err != nil {
+			log.Fatalf("--known-hosts: %v\n", err)
+		}
+	}
+
+	credentials := map[string]xdcc.Credentials{}
+	if *authFile != "" {
+		if credentials, err = xdcc.LoadCredentials(*authFile); err != nil {
+			log.Fatalf("--auth-file: %v\n", err)
+		}
+	}
+
+	directory := xdcc.BotDirectory{Network: *network, Channel: *channel}
+	if *botsFile != "" {
+		if directory.Bots, err = xdcc.LoadBots(*botsFile); err != nil {
+			log.Fatalf("--bots: %v\n", err)
+		}
+	}
+
+	if *maxActive < 0 || *maxPerNetwork < 0 || *maxPerBot < 0 {
+		log.Fatalf("--max-active, --max-per-network, --max-per-bot: must not be negative\n")
+	}
+
+	if *retryMax < 1 {
+		log.Fatalf("--retry-max: must be at least 1\n")
+	}
+
+	var advertisedIP net.IP
+	if *dccIP != "" {
+		if advertisedIP = net.ParseIP(*dccIP); advertisedIP == nil {
+			log.Fatalf("--dcc-ip: invalid IP address %s\n", *dccIP)
+		}
+	}
+
 	if *inputFile != "" {
 		urlList = append(urlList, loadUrlListFile(*inputFile)...)
 	}
@@ -303,9 +567,25 @@ func execGet(args []string) {
 	successful := 0
 	failed := 0
 
+	transfers := make([]xdcc.Transfer, 0, len(urlList))
+	// transfers on the same network share one IRC connection
+	pool := xdcc.NewSessionPool()
+	// packs beyond the limits are requested once a download ends
+	scheduler := xdcc.NewScheduler(xdcc.Limits{
+		Global:     *maxActive,
+		PerNetwork: *maxPerNetwork,
+		PerBot:     *maxPerBot,
+	})
+	// all transfers share the global limit
+	var globalRateLimit *xdcc.RateLimiter
+	if globalLimitRateBytes > 0 {
+		globalRateLimit = xdcc.NewRateLimiter(float64(globalLimitRateBytes))
+	}
+
 	wg := sync.WaitGroup{}
-	for _, urlStr := range urlList {
-		url, err := xdcc.ParseURL(urlStr)
+	for _, entry := range urlList {
+		urlStr, expectedSize := splitExpectedSize(entry)
+		packs, err := directory.ParsePacks(urlStr)
 		if errors.Is(err, xdcc.ErrInvalidURL) {
 			if *format == "jsonl" {
 				emitJSONLEvent(output.JSONLEvent{
@@ -316,7 +596,7 @@ func execGet(args []string) {
 					Fatal:     true,
 				})
 			} else {
-				fmt.Printf("no valid irc url: %s\n", urlStr)
+				fmt.Printf("no valid irc url: %s (%v)\n", urlStr, err)
 			}
 			continue
 		}
@@ -336,27 +616,91 @@ func execGet(args []string) {
 			os.Exit(1)
 		}
 
-		transfer := xdcc.NewTransfer(xdcc.Config{
-			File:              *url,
-			OutPath:           *path,
-			SSLOnly:           *sslOnly,
-			SanitizeFilenames: *sanitizeFilenames,
-		})
+		// the size given in the list takes precedence over the one of a
+		// search result row. A URL naming several packs starts a transfer
+		// for each of them, the size cannot apply to all
+		if expectedSize == 0 {
+			expectedSize = packs.Size
+		}
+		if len(packs.Slots) > 1 {
+			expectedSize = 0
+		}
+		for _, file := range packs.Files() {
+			// commands and search results are reported as URLs
+			fileURL := urlStr
+			if len(packs.Slots) > 1 || strings.ContainsAny(urlStr, " \t") {
+				fileURL = file.String()
+			}
 
-		totalTransfers++
-		wg.Add(1)
-		go func(transfer xdcc.Transfer, fmt string, urlStr string) {
-			success := doTransfer(transfer, fmt, urlStr)
-			resultsMutex.Lock()
-			if success {
-				successful++
-			} else {
-				failed++
+			var rateLimit *xdcc.RateLimiter
+			if limitRateBytes > 0 {
+				rateLimit = xdcc.NewRateLimiter(float64(limitRateBytes))
 			}
-			resultsMutex.Unlock()
-			wg.Done()
-		}(transfer, *format, urlStr)
+
+			transfer := xdcc.NewTransfer(xdcc.Config{
+				File:            file,
+				OutPath:         *path,
+				SSLOnly:         *sslOnly,
+				Filenames:       filenamePolicy,
+				OnExists:        existsPolicy,
+				TLS:             tlsConfig,
+				Identity:        identity,
+				Pool:            pool,
+				Scheduler:       scheduler,
+				RateLimit:       rateLimit,
+				GlobalRateLimit: globalRateLimit,
+				Auth:            credentials[strings.ToLower(file.Network)],
+				PassivePorts:    passivePorts,
+				AdvertisedIP:    advertisedIP,
+				AckMode:         ackMode,
+				Size: xdcc.SizePolicy{
+					MaxSize:      maxSizeBytes,
+					Expected:     expectedSize,
+					MaxDeviation: *maxSizeDeviation,
+					Preallocate:  *preallocate,
+				},
+				Checksum: xdcc.ChecksumPolicy{
+					AskBot:         *xdccInfo,
+					FailOnMismatch: *failOnMismatch,
+				},
+				Timeouts: xdcc.Timeouts{
+					Connect: *connectTimeout,
+					Join:    *joinTimeout,
+					Offer:   *offerTimeout,
+					Queued:  *queueTimeout,
+				},
+				Stall: xdcc.StallPolicy{
+					Timeout:        *stallTimeout,
+					MinSpeed:       float64(minSpeedBytes),
+					MinSpeedPeriod: *minSpeedPeriod,
+				},
+				Retry: xdcc.RetryPolicy{
+					MaxAttempts:    *retryMax,
+					InitialBackoff: *retryBackoff,
+					MaxBackoff:     *retryMaxBackoff,
+					Multiplier:     xdcc.DefaultRetryPolicy.Multiplier,
+					Jitter:         *retryJitter,
+					TLSModes:       tlsModeList,
+				},
+			})
+
+			transfers = append(transfers, transfer)
+			totalTransfers++
+			wg.Add(1)
+			go func(transfer xdcc.Transfer, fmt string, urlStr string) {
+				success := doTransfer(transfer, fmt, urlStr)
+				resultsMutex.Lock()
+				if success {
+					successful++
+				} else {
+					failed++
+				}
+				resultsMutex.Unlock()
+				wg.Done()
+			}(transfer, *format, fileURL)
+		}
 	}
+	cancelOnInterrupt(transfers)
 	wg.Wait()
 
 	// Emit finished event for JSONL format
@@ -27,6 +27,14 @@ func (f *CLIFormatter) OnConnected(event *xdcc.TransferConnectedEvent) {
 	// CLI formatter doesn't display connected events
 }
 
+func (f *CLIFormatter) OnWaiting(event *xdcc.TransferWaitingEvent) {
+	f.bar.SetState(pb.ProgressStateWaiting)
+}
+
+func (f *CLIFormatter) OnQueued(event *xdcc.TransferQueuedEvent) {
+	f.bar.SetState(pb.ProgressStateQueued)
+}
+
 func (f *CLIFormatter) OnStarted(event *xdcc.TransferStartedEvent) {
 	f.bar.SetTotal(int(event.FileSize))
 	f.bar.SetFileName(event.FileName)
@@ -34,6 +42,11 @@ func (f *CLIFormatter) OnStarted(event *xdcc.TransferStartedEvent) {
 	f.previousBytes = 0
 }
 
+func (f *CLIFormatter) OnResumed(event *xdcc.TransferResumedEvent) {
+	f.bar.SetCurrent(int(event.Offset))
+	f.previousBytes = event.Offset
+}
+
 func (f *CLIFormatter) OnProgress(event *xdcc.TransferProgessEvent, totalBytes uint64) {
 	// TransferBytes is cumulative, so calculate the increment
 	increment := event.TransferBytes - f.previousBytes
@@ -42,14 +55,27 @@ func (f *CLIFormatter) OnProgress(event *xdcc.TransferProgessEvent, totalBytes u
 }
 
 func (f *CLIFormatter) OnCompleted(event *xdcc.TransferCompletedEvent) {
+	if event.Verification.Status == xdcc.VerificationMismatch {
+		f.bar.SetState(pb.ProgressStateCorrupted)
+		return
+	}
 	f.bar.SetState(pb.ProgressStateCompleted)
 }
 
+func (f *CLIFormatter) OnSkipped(event *xdcc.TransferSkippedEvent) {
+	f.bar.SetFileName(event.FileName)
+	f.bar.SetState(pb.ProgressStateSkipped)
+}
+
 func (f *CLIFormatter) OnError(event *xdcc.TransferErrorEvent) {
 	// CLI formatter doesn't display non-fatal errors
 }
 
 func (f *CLIFormatter) OnAborted(event *xdcc.TransferAbortedEvent) {
+	if event.Cancelled {
+		f.bar.SetState(pb.ProgressStateCancelled)
+		return
+	}
 	f.bar.SetState(pb.ProgressStateAborted)
 }
 
@@ -11,9 +11,18 @@ type TransferOutputFormatter interface {
 	// OnConnected is called when successfully connected to IRC
 	OnConnected(event *xdcc.TransferConnectedEvent)
 
+	// OnWaiting is called when a concurrency limit holds the request back
+	OnWaiting(event *xdcc.TransferWaitingEvent)
+
+	// OnQueued is called when the bot put the request in its queue
+	OnQueued(event *xdcc.TransferQueuedEvent)
+
 	// OnStarted is called when the file transfer begins
 	OnStarted(event *xdcc.TransferStartedEvent)
 
+	// OnResumed is called when the bot accepted to continue a partial download
+	OnResumed(event *xdcc.TransferResumedEvent)
+
 	// OnProgress is called periodically during file transfer
 	// totalBytes is passed separately as it may not be in the event
 	OnProgress(event *xdcc.TransferProgessEvent, totalBytes uint64)
@@ -21,6 +30,9 @@ type TransferOutputFormatter interface {
 	// OnCompleted is called when the transfer finishes successfully
 	OnCompleted(event *xdcc.TransferCompletedEvent)
 
+	// OnSkipped is called when the file was already downloaded
+	OnSkipped(event *xdcc.TransferSkippedEvent)
+
 	// OnError is called when a non-fatal error occurs
 	OnError(event *xdcc.TransferErrorEvent)
 
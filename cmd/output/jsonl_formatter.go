@@ -2,6 +2,7 @@ package output
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -21,6 +22,20 @@ type JSONLEvent struct {
 	Slot    int    `json:"slot,omitempty"`
 	SSL     bool   `json:"ssl,omitempty"`
 
+	// Connected event fields, started and completed events use them for
+	// the DCC connection
+	Security        string `json:"security,omitempty"`
+	CertFingerprint string `json:"certFingerprint,omitempty"`
+	// Encrypted is only set on started and completed events
+	Encrypted *bool `json:"encrypted,omitempty"`
+
+	// Waiting event fields
+	Limit string `json:"limit,omitempty"`
+
+	// Queued event fields
+	Position int `json:"position,omitempty"`
+	Total    int `json:"total,omitempty"`
+
 	// Started/Progress/Completed event fields
 	FileName         string  `json:"fileName,omitempty"`
 	FileSize         uint64  `json:"fileSize,omitempty"`
@@ -32,15 +47,29 @@ type JSONLEvent struct {
 	Duration         float64 `json:"duration,omitempty"`
 	AvgRate          float64 `json:"avgRate,omitempty"`
 
+	// Completed event verification fields
+	Verification      string `json:"verification,omitempty"`
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+	Checksum          string `json:"checksum,omitempty"`
+	ExpectedChecksum  string `json:"expectedChecksum,omitempty"`
+
+	// Resumed event fields
+	Offset uint64 `json:"offset,omitempty"`
+
 	// Error event fields
 	Error     string `json:"error,omitempty"`
 	ErrorType string `json:"errorType,omitempty"`
 	Fatal     bool   `json:"fatal,omitempty"`
 
+	// Aborted event fields
+	Cancelled bool `json:"cancelled,omitempty"`
+
 	// Retry event fields
 	Attempt     int    `json:"attempt,omitempty"`
 	MaxAttempts int    `json:"maxAttempts,omitempty"`
 	Reason      string `json:"reason,omitempty"`
+	// Delay is the backoff before the attempt in seconds
+	Delay float64 `json:"delay,omitempty"`
 
 	// Finished event fields
 	TotalTransfers int `json:"totalTransfers,omitempty"`
@@ -91,18 +120,52 @@ func (f *JSONLFormatter) OnConnecting(event *xdcc.TransferConnectingEvent) {
 
 func (f *JSONLFormatter) OnConnected(event *xdcc.TransferConnectedEvent) {
 	f.emitEvent(JSONLEvent{
-		Type: "connected",
-		URL:  event.URL,
+		Type:            "connected",
+		URL:             event.URL,
+		Security:        string(event.Security),
+		CertFingerprint: event.CertFingerprint,
+	})
+}
+
+func (f *JSONLFormatter) OnWaiting(event *xdcc.TransferWaitingEvent) {
+	f.emitEvent(JSONLEvent{
+		Type:  "waiting",
+		URL:   event.URL,
+		Limit: event.Limit,
+	})
+}
+
+func (f *JSONLFormatter) OnQueued(event *xdcc.TransferQueuedEvent) {
+	f.emitEvent(JSONLEvent{
+		Type:     "queued",
+		URL:      event.URL,
+		Position: event.Position,
+		Total:    event.Total,
 	})
 }
 
 func (f *JSONLFormatter) OnStarted(event *xdcc.TransferStartedEvent) {
+	encrypted := event.Encrypted
+	f.emitEvent(JSONLEvent{
+		Type:            "started",
+		URL:             f.urlStr,
+		FileName:        event.FileName,
+		FileSize:        event.FileSize,
+		FilePath:        event.FilePath,
+		Security:        string(event.Security),
+		CertFingerprint: event.CertFingerprint,
+		Encrypted:       &encrypted,
+	})
+}
+
+func (f *JSONLFormatter) OnResumed(event *xdcc.TransferResumedEvent) {
 	f.emitEvent(JSONLEvent{
-		Type:     "started",
+		Type:     "resumed",
 		URL:      f.urlStr,
 		FileName: event.FileName,
 		FileSize: event.FileSize,
 		FilePath: event.FilePath,
+		Offset:   event.Offset,
 	})
 }
 
@@ -122,14 +185,31 @@ func (f *JSONLFormatter) OnProgress(event *xdcc.TransferProgessEvent, totalBytes
 }
 
 func (f *JSONLFormatter) OnCompleted(event *xdcc.TransferCompletedEvent) {
+	encrypted := event.Encrypted
+	f.emitEvent(JSONLEvent{
+		Type:              "completed",
+		URL:               f.urlStr,
+		FileName:          event.FileName,
+		FileSize:          event.FileSize,
+		FilePath:          event.FilePath,
+		Duration:          event.Duration,
+		AvgRate:           event.AvgRate,
+		Verification:      string(event.Verification.Status),
+		ChecksumAlgorithm: string(event.Verification.Algorithm),
+		Checksum:          event.Verification.Actual,
+		ExpectedChecksum:  event.Verification.Expected,
+		Security:          string(event.Security),
+		Encrypted:         &encrypted,
+	})
+}
+
+func (f *JSONLFormatter) OnSkipped(event *xdcc.TransferSkippedEvent) {
 	f.emitEvent(JSONLEvent{
-		Type:     "completed",
+		Type:     "skipped",
 		URL:      f.urlStr,
 		FileName: event.FileName,
 		FileSize: event.FileSize,
 		FilePath: event.FilePath,
-		Duration: event.Duration,
-		AvgRate:  event.AvgRate,
 	})
 }
 
@@ -139,15 +219,32 @@ func (f *JSONLFormatter) OnError(event *xdcc.TransferErrorEvent) {
 		URL:       event.URL,
 		Error:     event.Error,
 		ErrorType: event.ErrorType,
+		Reason:    errorReason(event.Err),
 		Fatal:     event.Fatal,
 	})
 }
 
+// errorReason returns why a bot or an offer was refused, if err tells.
+func errorReason(err error) string {
+	var (
+		offerErr *xdcc.OfferRejectedError
+		botErr   *xdcc.BotRejectionError
+	)
+	switch {
+	case errors.As(err, &offerErr):
+		return string(offerErr.Reason)
+	case errors.As(err, &botErr):
+		return string(botErr.Reason)
+	}
+	return ""
+}
+
 func (f *JSONLFormatter) OnAborted(event *xdcc.TransferAbortedEvent) {
 	f.emitEvent(JSONLEvent{
-		Type:   "aborted",
-		URL:    f.urlStr,
-		Reason: event.Error,
+		Type:      "aborted",
+		URL:       f.urlStr,
+		Reason:    event.Error,
+		Cancelled: event.Cancelled,
 	})
 }
 
@@ -158,6 +255,7 @@ func (f *JSONLFormatter) OnRetry(event *xdcc.TransferRetryEvent) {
 		Attempt:     event.Attempt,
 		MaxAttempts: event.MaxAttempts,
 		Reason:      event.Reason,
+		Delay:       event.Delay.Seconds(),
 	})
 }
 
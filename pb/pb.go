@@ -12,13 +12,19 @@ type ProgressState string
 
 const (
 	ProgressStateConnecting  ProgressState = "connecting"
+	ProgressStateWaiting     ProgressState = "waiting"
+	ProgressStateQueued      ProgressState = "queued"
 	ProgressStateDownloading ProgressState = "downloading"
 	ProgressStateCompleted   ProgressState = "done"
+	ProgressStateCorrupted   ProgressState = "corrupted"
+	ProgressStateSkipped     ProgressState = "skipped"
 	ProgressStateAborted     ProgressState = "aborted"
+	ProgressStateCancelled   ProgressState = "cancelled"
 )
 
 type ProgressBar interface {
 	Increment(n int)
+	SetCurrent(n int)
 	SetTotal(n int)
 	SetFileName(fileName string)
 	SetState(state ProgressState)
@@ -97,6 +103,10 @@ func (bar *progressBarImpl) SetTotal(n int) {
 	bar.Bar.SetTotal(int64(n), false)
 }
 
+func (bar *progressBarImpl) SetCurrent(n int) {
+	bar.Bar.SetCurrent(int64(n))
+}
+
 func (bar *progressBarImpl) SetFileName(fileName string) {
 	bar.fileName = fileName
 }
@@ -0,0 +1,68 @@
+package xdcc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// AckMode selects how received bytes are acknowledged on the DCC socket.
+// Classic DCC expects the receiver to write back the number of bytes
+// received so far as a network byte order integer after every packet.
+type AckMode string
+
+const (
+	// AckAuto picks AckNone, Ack32 or Ack64 depending on the offer.
+	AckAuto AckMode = "auto"
+	// AckNone never writes acknowledgements (turbo / TSEND).
+	AckNone AckMode = "none"
+	// Ack32 writes 32-bit acknowledgements, wrapping after 4 GiB.
+	Ack32 AckMode = "32"
+	// Ack64 writes 64-bit acknowledgements, needed by some bots for files over 4 GiB.
+	Ack64 AckMode = "64"
+)
+
+var ErrInvalidAckMode = errors.New("invalid ack mode")
+
+func ParseAckMode(s string) (AckMode, error) {
+	switch mode := AckMode(s); mode {
+	case "":
+		return AckAuto, nil
+	case AckAuto, AckNone, Ack32, Ack64:
+		return mode, nil
+	}
+	return "", ErrInvalidAckMode
+}
+
+// resolve returns the concrete mode to use for the given offer.
+func (mode AckMode) resolve(send *XdccSendRes) AckMode {
+	if mode != AckAuto && mode != "" {
+		return mode
+	}
+
+	if send.Turbo {
+		return AckNone
+	}
+	if int64(send.FileSize) > math.MaxUint32 {
+		return Ack64
+	}
+	return Ack32
+}
+
+// writeAck acknowledges the given absolute position in the file.
+func (mode AckMode) writeAck(w io.Writer, position uint64) error {
+	var buf [8]byte
+
+	switch mode {
+	case Ack32:
+		binary.BigEndian.PutUint32(buf[:4], uint32(position))
+		_, err := w.Write(buf[:4])
+		return err
+	case Ack64:
+		binary.BigEndian.PutUint64(buf[:], position)
+		_, err := w.Write(buf[:])
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package xdcc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAckModeResolve(t *testing.T) {
+	tests := []struct {
+		mode     AckMode
+		send     XdccSendRes
+		expected AckMode
+	}{
+		{AckAuto, XdccSendRes{FileSize: 1 << 20}, Ack32},
+		{"", XdccSendRes{FileSize: 1 << 20}, Ack32},
+		{AckAuto, XdccSendRes{FileSize: 1 << 32}, Ack64},
+		{AckAuto, XdccSendRes{FileSize: 1 << 32, Turbo: true}, AckNone},
+		{AckAuto, XdccSendRes{}, Ack32},
+		{Ack32, XdccSendRes{FileSize: 1 << 32}, Ack32},
+		{Ack64, XdccSendRes{FileSize: 1 << 20}, Ack64},
+		{AckNone, XdccSendRes{FileSize: 1 << 20}, AckNone},
+	}
+
+	for _, test := range tests {
+		if got := test.mode.resolve(&test.send); got != test.expected {
+			t.Errorf("%q.resolve(%+v) = %q, want %q", test.mode, test.send, got, test.expected)
+		}
+	}
+}
+
+func TestAckModeWriteAck(t *testing.T) {
+	tests := []struct {
+		mode     AckMode
+		position uint64
+		expected []byte
+	}{
+		{Ack32, 1000, []byte{0, 0, 0x03, 0xe8}},
+		{Ack32, 1<<32 - 1, []byte{0xff, 0xff, 0xff, 0xff}},
+		// 32-bit acks wrap past 4 GiB
+		{Ack32, 1<<32 + 5, []byte{0, 0, 0, 5}},
+		{Ack64, 1000, []byte{0, 0, 0, 0, 0, 0, 0x03, 0xe8}},
+		{Ack64, 1<<32 + 5, []byte{0, 0, 0, 1, 0, 0, 0, 5}},
+		{AckNone, 1000, nil},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := test.mode.writeAck(&buf, test.position); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("%q.writeAck(%d) wrote %x, want %x", test.mode, test.position, buf.Bytes(), test.expected)
+		}
+	}
+}
+
+func TestAcknowledgeTimeout(t *testing.T) {
+	ours, bot := net.Pipe()
+	defer ours.Close()
+	defer bot.Close()
+
+	// the bot does not read the acknowledgements
+	transfer := newXdccTransfer(Config{Stall: StallPolicy{Timeout: 50 * time.Millisecond}})
+	done := make(chan error, 1)
+	go func() { done <- transfer.acknowledge(ours, Ack32, 1024) }()
+
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Errorf("got %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acknowledgement blocked past the stall timeout")
+	}
+
+	// without a stall timeout nothing changes for bots reading them
+	ours.SetWriteDeadline(time.Time{})
+	transfer = newXdccTransfer(Config{})
+	go func() { done <- transfer.acknowledge(ours, Ack32, 1024) }()
+	ack := make([]byte, 4)
+	if _, err := bot.Read(ack); err != nil || !bytes.Equal(ack, []byte{0, 0, 4, 0}) {
+		t.Errorf("got ack %v, %v, want 1024", ack, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("got %v, want the ack written", err)
+	}
+}
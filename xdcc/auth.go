@@ -0,0 +1,393 @@
+package xdcc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"xdcc-cli/proxy"
+
+	irc "github.com/fluffle/goirc/client"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// AuthMethod is the way the client identifies to the network.
+type AuthMethod string
+
+const (
+	// AuthNone connects with an anonymous nick.
+	AuthNone AuthMethod = ""
+	// AuthSASLPlain sends the account and password during registration.
+	AuthSASLPlain AuthMethod = "sasl-plain"
+	// AuthSASLExternal identifies with the TLS client certificate.
+	AuthSASLExternal AuthMethod = "sasl-external"
+	// AuthNickServ sends IDENTIFY to NickServ once registered.
+	AuthNickServ AuthMethod = "nickserv"
+)
+
+// Credentials identify the client to a network. Bots that only serve
+// registered users are not asked for a pack before identification succeeded.
+type Credentials struct {
+	Method   AuthMethod
+	Account  string
+	Password string
+	// Certificate is the client certificate of AuthSASLExternal.
+	Certificate *tls.Certificate
+}
+
+// AuthError is reported when the network refused the credentials.
+type AuthError struct {
+	Method  AuthMethod
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s authentication failed: %s", e.Method, e.Message)
+}
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LoadCredentials reads per-network credentials, one network per line:
+//
+//	<network> sasl-plain <account> <password>
+//	<network> nickserv <account> <password>
+//	<network> sasl-external <cert.pem> [key.pem]
+//
+// Empty lines and lines starting with # are ignored. The returned map is
+// keyed by lower-case network.
+func LoadCredentials(path string) (map[string]Credentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	credentials := map[string]Credentials{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		creds, err := parseCredentials(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		credentials[strings.ToLower(fields[0])] = creds
+	}
+	return credentials, scanner.Err()
+}
+
+func parseCredentials(fields []string) (Credentials, error) {
+	if len(fields) == 0 {
+		return Credentials{}, ErrInvalidCredentials
+	}
+
+	switch method := AuthMethod(fields[0]); method {
+	case AuthSASLPlain, AuthNickServ:
+		if len(fields) != 3 {
+			return Credentials{}, fmt.Errorf("%w: %s needs an account and a password", ErrInvalidCredentials, method)
+		}
+		return Credentials{Method: method, Account: fields[1], Password: fields[2]}, nil
+	case AuthSASLExternal:
+		if len(fields) != 2 && len(fields) != 3 {
+			return Credentials{}, fmt.Errorf("%w: %s needs a certificate file", ErrInvalidCredentials, method)
+		}
+		keyFile := fields[len(fields)-1]
+		cert, err := tls.LoadX509KeyPair(fields[1], keyFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+		return Credentials{Method: method, Certificate: &cert}, nil
+	}
+	return Credentials{}, fmt.Errorf("%w: unknown method %q", ErrInvalidCredentials, fields[0])
+}
+
+// authState tracks identification on the current connection.
+type authState int
+
+const (
+	authPending authState = iota
+	authDone
+	authFailed
+)
+
+// saslChunkSize is the longest AUTHENTICATE payload, longer ones are split.
+const saslChunkSize = 400
+
+var (
+	nickServSuccessRegexp = regexp.MustCompile(`(?i)you are now (identified|logged in|recognized)|password accepted`)
+	nickServFailureRegexp = regexp.MustCompile(`(?i)invalid password|password incorrect|incorrect password|is not a registered|isn't registered|not registered`)
+)
+
+// saslDialScheme is the proxy scheme the library dials SASL sessions with.
+// irc.Conn sends NICK and USER as soon as it is connected, the dialer of
+// the session starts the capability negotiation first, so that the server
+// suspends registration until SASL completed.
+const saslDialScheme = "xdcc-sasl"
+
+var (
+	saslSessions   sync.Map
+	saslSessionSeq atomic.Uint64
+)
+
+func init() {
+	netproxy.RegisterDialerType(saslDialScheme, func(u *url.URL, _ netproxy.Dialer) (netproxy.Dialer, error) {
+		s, ok := saslSessions.Load(u.Host)
+		if !ok {
+			return nil, fmt.Errorf("no session %s", u.Host)
+		}
+		return saslDialer{s.(*session)}, nil
+	})
+}
+
+// saslDialer connects a SASL session through the configured proxy and
+// secures it itself, the library sees a plain connection.
+type saslDialer struct {
+	s *session
+}
+
+func (d saslDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d saslDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := proxy.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.s.tlsMode != TLSModePlain {
+		tlsConn := tls.Client(conn, d.s.conn.Config().SSLConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	d.s.setAuthState(authPending, nil)
+	if _, err := io.WriteString(conn, "CAP LS 302\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setupAuthHandlers negotiates SASL during registration, and handles the
+// replies of NickServ and the account numerics.
+func (s *session) setupAuthHandlers() {
+	conn := s.conn
+
+	if s.usesSASL() {
+		id := strconv.FormatUint(saslSessionSeq.Add(1), 10)
+		saslSessions.Store(id, s)
+		context.AfterFunc(s.ctx, func() {
+			saslSessions.Delete(id)
+		})
+		conn.Config().Proxy = saslDialScheme + "://" + id
+	}
+
+	// SASL sessions start over when dialing, before the server can answer
+	conn.HandleFunc(irc.REGISTER, func(conn *irc.Conn, line *irc.Line) {
+		if !s.usesSASL() {
+			s.setAuthState(authPending, nil)
+		}
+	})
+
+	// ERR_UNKNOWNCOMMAND, from servers that know nothing of capabilities
+	conn.HandleFunc("421", func(conn *irc.Conn, line *irc.Line) {
+		if s.usesSASL() && len(line.Args) > 1 && strings.EqualFold(line.Args[1], irc.CAP) {
+			s.authFailed("server does not support SASL")
+		}
+	})
+
+	conn.HandleFunc(irc.CAP, func(conn *irc.Conn, line *irc.Line) {
+		if !s.usesSASL() || len(line.Args) < 3 {
+			return
+		}
+		// the capabilities may span several LS replies, all but the last
+		// with "*" before the list. A server without SASL refuses the request
+		if strings.EqualFold(line.Args[1], "LS") {
+			if len(line.Args) == 3 {
+				conn.Cap("REQ", "sasl")
+			}
+			return
+		}
+		if !strings.EqualFold(strings.TrimSpace(line.Args[2]), "sasl") {
+			return
+		}
+		switch strings.ToUpper(line.Args[1]) {
+		case "ACK":
+			conn.Raw("AUTHENTICATE " + strings.ToUpper(strings.TrimPrefix(string(s.auth.Method), "sasl-")))
+		case "NAK":
+			s.authFailed("server does not support SASL")
+			conn.Cap("END")
+		}
+	})
+
+	conn.HandleFunc("AUTHENTICATE", func(conn *irc.Conn, line *irc.Line) {
+		if len(line.Args) == 0 || line.Args[0] != "+" {
+			return
+		}
+		if s.auth.Method == AuthSASLExternal {
+			conn.Raw("AUTHENTICATE +")
+			return
+		}
+		payload := s.auth.Account + "\x00" + s.auth.Account + "\x00" + s.auth.Password
+		for _, chunk := range saslChunks(base64.StdEncoding.EncodeToString([]byte(payload))) {
+			conn.Raw("AUTHENTICATE " + chunk)
+		}
+	})
+
+	// RPL_SASLSUCCESS, ERR_SASLALREADY
+	for _, numeric := range []string{"903", "907"} {
+		conn.HandleFunc(numeric, func(conn *irc.Conn, line *irc.Line) {
+			conn.Cap("END")
+			s.authCompleted(nil)
+		})
+	}
+
+	// ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+	for _, numeric := range []string{"902", "904", "905", "906"} {
+		conn.HandleFunc(numeric, func(conn *irc.Conn, line *irc.Line) {
+			s.authFailed(line.Text())
+			conn.Cap("END")
+		})
+	}
+
+	conn.HandleFunc(irc.NOTICE, func(conn *irc.Conn, line *irc.Line) {
+		if s.auth.Method != AuthNickServ || !strings.EqualFold(line.Nick, "NickServ") {
+			return
+		}
+		switch text := formattingRegexp.ReplaceAllString(line.Text(), ""); {
+		case nickServSuccessRegexp.MatchString(text):
+			s.identified()
+		case nickServFailureRegexp.MatchString(text):
+			s.identificationFailed(text)
+		}
+	})
+
+	// RPL_LOGGEDIN is also sent by services once NickServ accepted us
+	conn.HandleFunc("900", func(conn *irc.Conn, line *irc.Line) {
+		if s.auth.Method == AuthNickServ {
+			s.identified()
+		}
+	})
+}
+
+func saslChunks(encoded string) []string {
+	var chunks []string
+	for len(encoded) >= saslChunkSize {
+		chunks = append(chunks, encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+	if encoded == "" {
+		// a payload that is a multiple of the chunk size ends with "+"
+		return append(chunks, "+")
+	}
+	return append(chunks, encoded)
+}
+
+func (s *session) usesSASL() bool {
+	return s.auth.Method == AuthSASLPlain || s.auth.Method == AuthSASLExternal
+}
+
+func (s *session) setAuthState(state authState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authState = state
+	s.authErr = err
+}
+
+func (s *session) authFailed(message string) {
+	s.authCompleted(newTransferError(ErrorTypeAuth, &AuthError{Method: s.auth.Method, Message: message}))
+}
+
+// authCompleted records the outcome of the identification, only the first
+// one counts. Once the server welcomed us, the transfers join their
+// channels or fail right away.
+func (s *session) authCompleted(err error) {
+	s.mu.Lock()
+	if s.authState != authPending {
+		s.mu.Unlock()
+		return
+	}
+	s.authState, s.authErr = authDone, err
+	if err != nil {
+		s.authState = authFailed
+	}
+	registered := s.state == sessionRegistered
+	if registered && err == nil {
+		s.state = sessionReady
+	}
+	s.mu.Unlock()
+
+	if !registered {
+		return
+	}
+	s.each(func(transfer *XdccTransfer) {
+		if err != nil {
+			transfer.fail(err)
+		} else {
+			transfer.joinChannel()
+		}
+	})
+}
+
+// registered is called on the welcome of the server. It returns whether
+// the transfers can join their channels now, otherwise they wait for
+// NickServ or fail.
+func (s *session) registered() bool {
+	s.mu.Lock()
+	state, err := s.authState, s.authErr
+	s.mu.Unlock()
+
+	switch s.auth.Method {
+	case AuthNone:
+		return true
+	case AuthNickServ:
+		if s.auth.Account != "" {
+			s.conn.Privmsg("NickServ", "IDENTIFY "+s.auth.Account+" "+s.auth.Password)
+		} else {
+			s.conn.Privmsg("NickServ", "IDENTIFY "+s.auth.Password)
+		}
+		return false
+	}
+
+	switch state {
+	case authDone:
+		return true
+	case authPending:
+		// servers suspend registration until CAP END, a welcome before
+		// means the server ignored the negotiation
+		s.authFailed("server completed registration before SASL")
+	case authFailed:
+		s.each(func(transfer *XdccTransfer) {
+			transfer.fail(err)
+		})
+	}
+	return false
+}
+
+// identified lets the transfers join their channels once NickServ
+// accepted the password.
+func (s *session) identified() {
+	s.authCompleted(nil)
+}
+
+func (s *session) identificationFailed(message string) {
+	s.authFailed(message)
+}
@@ -0,0 +1,163 @@
+package xdcc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIRCServer accepts one client on a loopback port. For each line of the
+// client it writes the replies of script for the whole line, else for its
+// command, with $nick replaced by the nick of the client. The lines of the
+// client are passed on to the returned channel.
+func fakeIRCServer(t *testing.T, script map[string][]string) (int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		nick := "*"
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			command, _, _ := strings.Cut(line, " ")
+			if command == "NICK" {
+				nick = strings.TrimPrefix(strings.TrimPrefix(line, "NICK "), ":")
+			}
+			lines <- line
+
+			replies, ok := script[line]
+			if !ok {
+				replies = script[command]
+			}
+			for _, reply := range replies {
+				fmt.Fprintf(conn, "%s\r\n", strings.ReplaceAll(reply, "$nick", nick))
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, lines
+}
+
+// waitJoinOrAbort returns the lines the client sent until it joined its
+// channel, or the error the transfer failed with.
+func waitJoinOrAbort(t *testing.T, transfer *XdccTransfer, lines <-chan string) ([]string, string) {
+	var sent []string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			sent = append(sent, line)
+			if strings.HasPrefix(line, "JOIN #chan") {
+				return sent, ""
+			}
+		case e := <-transfer.PollEvents():
+			if aborted, ok := e.(*TransferAbortedEvent); ok {
+				return sent, aborted.Error
+			}
+		case <-timeout:
+			t.Fatalf("client neither joined nor failed, sent %q", sent)
+			return nil, ""
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	t.Parallel()
+	welcome := ":irc.test 001 $nick :Welcome"
+	plain := "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("account\x00account\x00secret"))
+	sasl := func(outcome string) map[string][]string {
+		return map[string][]string{
+			"CAP LS 302":         {":irc.test CAP * LS :multi-prefix sasl=PLAIN,EXTERNAL"},
+			"CAP REQ :sasl":      {":irc.test CAP $nick ACK :sasl"},
+			"AUTHENTICATE PLAIN": {"AUTHENTICATE +"},
+			plain:                {outcome},
+			"CAP END":            {welcome},
+		}
+	}
+	nickServ := func(reply string) map[string][]string {
+		return map[string][]string{
+			"USER": {welcome},
+			"PRIVMSG NickServ :IDENTIFY account secret": {":NickServ!service@services.test NOTICE $nick :" + reply},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method AuthMethod
+		script map[string][]string
+		err    string
+	}{
+		{"sasl success", AuthSASLPlain, sasl(":irc.test 903 $nick :SASL authentication successful"), ""},
+		{"sasl already authenticated", AuthSASLPlain, sasl(":irc.test 907 $nick :You have already authenticated using SASL"), ""},
+		{"sasl failure", AuthSASLPlain, sasl(":irc.test 904 $nick :SASL authentication failed"), "SASL authentication failed"},
+		{"sasl ignored", AuthSASLPlain, map[string][]string{
+			"USER": {welcome},
+		}, "server completed registration before SASL"},
+		{"sasl not supported", AuthSASLPlain, map[string][]string{
+			"USER":       {welcome},
+			"CAP LS 302": {":irc.test 421 * CAP :Unknown command"},
+		}, "server does not support SASL"},
+		{"sasl refused", AuthSASLPlain, map[string][]string{
+			"CAP LS 302":    {":irc.test CAP * LS * :multi-prefix", ":irc.test CAP * LS :away-notify"},
+			"CAP REQ :sasl": {":irc.test CAP $nick NAK :sasl"},
+			"CAP END":       {welcome},
+		}, "server does not support SASL"},
+		{"nickserv success", AuthNickServ, nickServ("Password accepted - you are now recognized."), ""},
+		{"nickserv failure", AuthNickServ, nickServ("Invalid password for account."), "Invalid password for account."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the flood control of the client delays the SASL exchange by seconds
+			t.Parallel()
+			port, lines := fakeIRCServer(t, test.script)
+			transfer := newXdccTransfer(Config{
+				File:  IRCFile{Network: "127.0.0.1", Port: port, Channel: "#chan", UserName: "Bot", Slot: 1},
+				TLS:   TLSPolicy{Security: TLSPlaintextAllowed},
+				Retry: RetryPolicy{MaxAttempts: 1, TLSModes: []TLSMode{TLSModePlain}},
+				Auth:  Credentials{Method: test.method, Account: "account", Password: "secret"},
+			})
+			t.Cleanup(func() { transfer.Cancel(context.Background()) })
+			if err := transfer.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			sent, err := waitJoinOrAbort(t, transfer, lines)
+			// servers only suspend registration for a negotiation started first
+			if test.method != AuthNickServ && (len(sent) == 0 || sent[0] != "CAP LS 302") {
+				t.Errorf("registered before negotiating capabilities, sent %q", sent)
+			}
+			if test.err == "" {
+				if err != "" {
+					t.Fatalf("got error %q, want the channel joined", err)
+				}
+			} else if !strings.Contains(err, test.err) || !strings.Contains(err, "authentication failed") {
+				t.Fatalf("got error %q, want %q", err, test.err)
+			}
+
+			// the channel is only joined once the server confirmed the identification
+			if test.err == "" && test.method != AuthNickServ {
+				for _, line := range sent {
+					if line == plain {
+						return
+					}
+				}
+				t.Errorf("joined before authenticating, sent %q", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package xdcc
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BotRejectionReason tells why a bot refused to send a pack.
+type BotRejectionReason string
+
+const (
+	BotRejectInvalidPack      BotRejectionReason = "invalid-pack"
+	BotRejectAlreadyRequested BotRejectionReason = "already-requested"
+	BotRejectQueueFull        BotRejectionReason = "queue-full"
+	BotRejectDenied           BotRejectionReason = "denied"
+	BotRejectClosed           BotRejectionReason = "closed"
+)
+
+// BotRejectionError is reported when the bot answers a request with a refusal.
+type BotRejectionError struct {
+	Reason  BotRejectionReason
+	Message string
+}
+
+func (e *BotRejectionError) Error() string {
+	return "rejected by bot: " + e.Message
+}
+
+// Fatal reports whether the bot will not send the pack at all.
+// A duplicate request usually means an earlier one is still queued.
+func (e *BotRejectionError) Fatal() bool {
+	return e.Reason != BotRejectAlreadyRequested
+}
+
+// botQueued is the result of parsing a queue notice.
+type botQueued struct {
+	Position int
+	Total    int
+}
+
+var (
+	botQueuePositionRegexp = regexp.MustCompile(`(?i)\bposition\s+#?(\d+)(?:\s*(?:of|/)\s*(\d+))?`)
+	botQueueRegexp         = regexp.MustCompile(`(?i)\bqueue(d)?\b`)
+	botPackRegexp          = regexp.MustCompile(`(?i)\bpack\s+#?(\d+)`)
+
+	botRejections = []struct {
+		reason BotRejectionReason
+		regexp *regexp.Regexp
+	}{
+		{BotRejectInvalidPack, regexp.MustCompile(`(?i)invalid pack number`)},
+		{BotRejectAlreadyRequested, regexp.MustCompile(`(?i)already requested that pack|already have that item queued|already in queue`)},
+		{BotRejectQueueFull, regexp.MustCompile(`(?i)queue(?: of size \d+)? is full|queue.*full, try again`)},
+		{BotRejectDenied, regexp.MustCompile(`(?i)xdcc send denied|access denied`)},
+		{BotRejectClosed, regexp.MustCompile(`(?i)no new connections|bot is internal only|xdcc is closed`)},
+	}
+)
+
+// formattingRegexp matches mIRC color, bold, underline, italic, reverse and reset codes.
+var formattingRegexp = regexp.MustCompile("\x03(?:\\d{1,2}(?:,\\d{1,2})?)?|[\x02\x0f\x16\x1d\x1f]")
+
+// parseBotMessage recognizes the NOTICE/PRIVMSG replies of common
+// iroffer and Sysreset bots. It returns a *botQueued, a
+// *BotRejectionError, a *botChecksum, or nil when the message is purely
+// informational.
+func parseBotMessage(text string) interface{} {
+	text = strings.TrimSpace(formattingRegexp.ReplaceAllString(text, ""))
+
+	if checksum := parseBotChecksum(text); checksum != nil {
+		return checksum
+	}
+
+	// "Added you to the main queue ... in position 2" is checked first as it
+	// often comes after an "All Slots Full" or "only 1 transfer" preamble.
+	if botQueueRegexp.MatchString(text) {
+		if m := botQueuePositionRegexp.FindStringSubmatch(text); m != nil {
+			queued := &botQueued{}
+			queued.Position, _ = strconv.Atoi(m[1])
+			if m[2] != "" {
+				queued.Total, _ = strconv.Atoi(m[2])
+			}
+			return queued
+		}
+	}
+
+	for _, rejection := range botRejections {
+		if rejection.regexp.MatchString(text) {
+			return &BotRejectionError{
+				Reason:  rejection.reason,
+				Message: strings.TrimSpace(strings.TrimLeft(text, "*")),
+			}
+		}
+	}
+	return nil
+}
+
+// botMessagePack returns the pack number a bot message refers to, if any,
+// e.g. "Added you to the main queue for pack 3".
+func botMessagePack(text string) (int, bool) {
+	m := botPackRegexp.FindStringSubmatch(formattingRegexp.ReplaceAllString(text, ""))
+	if m == nil {
+		return 0, false
+	}
+	pack, err := strconv.Atoi(m[1])
+	return pack, err == nil
+}
@@ -0,0 +1,94 @@
+package xdcc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBotMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{
+			name:     "iroffer main queue",
+			input:    `** You can only have 1 transfer at a time, Added you to the main queue for pack 3 ("file.mkv") in position 2. To Remove yourself at a later time type "/MSG Bot XDCC REMOVE 3".`,
+			expected: &botQueued{Position: 2},
+		},
+		{
+			name:     "all slots full",
+			input:    `** All Slots Full, Added you to the main queue for pack 1 ("file.mkv") in position 5. To Remove yourself at a later time type "/MSG Bot XDCC REMOVE 1".`,
+			expected: &botQueued{Position: 5},
+		},
+		{
+			name:     "queue position with total",
+			input:    "You have been queued, position 3 of 10",
+			expected: &botQueued{Position: 3, Total: 10},
+		},
+		{
+			name:     "periodic queue notice",
+			input:    `Queued 0h1m for "file.mkv", in position 2 of 3. 0h3m or more remaining.`,
+			expected: &botQueued{Position: 2, Total: 3},
+		},
+		{
+			name:     "colored queue notice",
+			input:    "\x0304,01Queued\x0f in position \x021\x02/4",
+			expected: &botQueued{Position: 1, Total: 4},
+		},
+		{
+			name:     "invalid pack",
+			input:    "** Invalid Pack Number, Try Again",
+			expected: &BotRejectionError{Reason: BotRejectInvalidPack, Message: "Invalid Pack Number, Try Again"},
+		},
+		{
+			name:     "already requested",
+			input:    "** You already requested that pack",
+			expected: &BotRejectionError{Reason: BotRejectAlreadyRequested, Message: "You already requested that pack"},
+		},
+		{
+			name:     "queue full",
+			input:    "** All Slots Full, Main queue of size 10 is Full, Try Again Later",
+			expected: &BotRejectionError{Reason: BotRejectQueueFull, Message: "All Slots Full, Main queue of size 10 is Full, Try Again Later"},
+		},
+		{
+			name:     "denied",
+			input:    "** XDCC SEND denied, you must be on a known channel to request a pack",
+			expected: &BotRejectionError{Reason: BotRejectDenied, Message: "XDCC SEND denied, you must be on a known channel to request a pack"},
+		},
+		{
+			name:     "xdcc info md5",
+			input:    " md5sum      D41D8CD98F00B204E9800998ECF8427E",
+			expected: &botChecksum{Algorithm: ChecksumMD5, Value: "d41d8cd98f00b204e9800998ecf8427e"},
+		},
+		{
+			name:     "xdcc info crc32",
+			input:    " crc32       ABCD1234",
+			expected: &botChecksum{Algorithm: ChecksumCRC32, Value: "abcd1234"},
+		},
+		{
+			name:     "xdcc info sha256",
+			input:    "SHA-256: e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			expected: &botChecksum{Algorithm: ChecksumSHA256, Value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		},
+		{
+			name:     "checksum of the wrong length",
+			input:    " md5sum      ABCD1234",
+			expected: nil,
+		},
+		{
+			name:     "informational message",
+			input:    `** Sending you pack #5 ("file.mkv"), which is 700MB. (resume supported)`,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseBotMessage(tt.input)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseBotMessage(%q) = %#v, want %#v", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package xdcc
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ChecksumAlgorithm is a hash function files are verified with.
+type ChecksumAlgorithm string
+
+const (
+	ChecksumCRC32  ChecksumAlgorithm = "crc32"
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+)
+
+// checksumAlgorithms lists the algorithms from the strongest to the weakest,
+// with the length of their hexadecimal digest.
+var checksumAlgorithms = []struct {
+	algorithm ChecksumAlgorithm
+	hexLen    int
+}{
+	{ChecksumSHA256, 64},
+	{ChecksumMD5, 32},
+	{ChecksumCRC32, 8},
+}
+
+// VerificationStatus is the outcome of the integrity check of a download.
+type VerificationStatus string
+
+const (
+	// VerificationUnverified means no checksum of the file was known.
+	VerificationUnverified VerificationStatus = "unverified"
+	VerificationVerified   VerificationStatus = "verified"
+	VerificationMismatch   VerificationStatus = "mismatch"
+)
+
+// Verification is reported by TransferCompletedEvent. Expected is empty
+// when the file is unverified, Actual is then its SHA-256.
+type Verification struct {
+	Status    VerificationStatus
+	Algorithm ChecksumAlgorithm
+	Expected  string
+	Actual    string
+}
+
+// ChecksumPolicy configures the integrity check of downloads. The CRC32
+// tag of file names, like "[ABCD1234]", is always checked.
+type ChecksumPolicy struct {
+	// AskBot sends "xdcc info" before requesting the pack, to learn the
+	// hashes published by the bot.
+	AskBot bool
+	// FailOnMismatch fails the transfer when the file does not match,
+	// otherwise the mismatch is only reported.
+	FailOnMismatch bool
+}
+
+// ChecksumMismatchError is reported when a downloaded file does not match
+// its expected checksum.
+type ChecksumMismatchError struct {
+	FileName  string
+	Algorithm ChecksumAlgorithm
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s of %s mismatch: expected %s, got %s", e.Algorithm, e.FileName, e.Expected, e.Actual)
+}
+
+// XdccInfoReq asks the bot for the details of a pack, including its hashes.
+type XdccInfoReq struct {
+	Slot int
+}
+
+func (info *XdccInfoReq) String() string {
+	return fmt.Sprintf("xdcc info #%d", info.Slot)
+}
+
+var (
+	// filenameCRCRegexp matches the CRC32 tag release groups put in names,
+	// in square brackets: parentheses mostly hold dates like (20231225)
+	filenameCRCRegexp = regexp.MustCompile(`\[([0-9A-Fa-f]{8})\]`)
+	decimalRegexp     = regexp.MustCompile(`^[0-9]+$`)
+	// botChecksumRegexp matches the hash lines of the "xdcc info" reply
+	botChecksumRegexp = regexp.MustCompile(`(?i)^(md5|crc32|sha-?256)(?:sum)?\s*:?\s+([0-9a-f]+)$`)
+)
+
+// botChecksum is the result of parsing a hash line of the bot.
+type botChecksum struct {
+	Algorithm ChecksumAlgorithm
+	Value     string
+}
+
+func parseBotChecksum(text string) *botChecksum {
+	m := botChecksumRegexp.FindStringSubmatch(text)
+	if m == nil {
+		return nil
+	}
+	algorithm := ChecksumAlgorithm(strings.ReplaceAll(strings.ToLower(m[1]), "-", ""))
+	for _, known := range checksumAlgorithms {
+		if known.algorithm == algorithm && known.hexLen == len(m[2]) {
+			return &botChecksum{Algorithm: algorithm, Value: strings.ToLower(m[2])}
+		}
+	}
+	return nil
+}
+
+// filenameChecksum returns the CRC32 tagged in the file name, the last
+// one when there are several. Tags of only digits, which may as well be
+// dates, are only used when there is no other.
+func filenameChecksum(name string) (string, bool) {
+	matches := filenameCRCRegexp.FindAllStringSubmatch(name, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+	for i := len(matches) - 1; i >= 0; i-- {
+		if !decimalRegexp.MatchString(matches[i][1]) {
+			return strings.ToLower(matches[i][1]), true
+		}
+	}
+	return matches[len(matches)-1][1], true
+}
+
+// checksummer computes all the supported hashes of the data written to it.
+type checksummer struct {
+	hashes map[ChecksumAlgorithm]hash.Hash
+	writer io.Writer
+}
+
+func newChecksummer() *checksummer {
+	c := &checksummer{hashes: map[ChecksumAlgorithm]hash.Hash{
+		ChecksumCRC32:  crc32.NewIEEE(),
+		ChecksumMD5:    md5.New(),
+		ChecksumSHA256: sha256.New(),
+	}}
+	writers := make([]io.Writer, 0, len(c.hashes))
+	for _, h := range c.hashes {
+		writers = append(writers, h)
+	}
+	c.writer = io.MultiWriter(writers...)
+	return c
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// readPrefix hashes the first n bytes of a partial file before resuming.
+func (c *checksummer) readPrefix(path string, n int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyN(c, file, n)
+	return err
+}
+
+func (c *checksummer) sum(algorithm ChecksumAlgorithm) string {
+	return hex.EncodeToString(c.hashes[algorithm].Sum(nil))
+}
+
+// verify compares the file against every expected checksum, it reports
+// the first mismatch or else the strongest match.
+func (c *checksummer) verify(expected map[ChecksumAlgorithm]string) Verification {
+	var result *Verification
+	for _, known := range checksumAlgorithms {
+		value, ok := expected[known.algorithm]
+		if !ok {
+			continue
+		}
+		actual := c.sum(known.algorithm)
+		if actual != value {
+			return Verification{Status: VerificationMismatch, Algorithm: known.algorithm, Expected: value, Actual: actual}
+		}
+		if result == nil {
+			result = &Verification{Status: VerificationVerified, Algorithm: known.algorithm, Expected: value, Actual: actual}
+		}
+	}
+	if result == nil {
+		return Verification{Status: VerificationUnverified, Algorithm: ChecksumSHA256, Actual: c.sum(ChecksumSHA256)}
+	}
+	return *result
+}
@@ -0,0 +1,59 @@
+package xdcc
+
+import "testing"
+
+func TestFilenameChecksum(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		ok       bool
+	}{
+		{"[Group] Show - 01 [1080p][ABCD1234].mkv", "abcd1234", true},
+		{"Show - 01 (abcd1234).mkv", "", false},
+		{"Show (20231225).mkv", "", false},
+		{"[12345678] Show - 01 [DEADBEEF].mkv", "deadbeef", true},
+		{"[Group] Show - 01 [DEADBEEF][20231225].mkv", "deadbeef", true},
+		{"[Group] Show - 01 [12345678].mkv", "12345678", true},
+		{"Show.S01E01.1080p.mkv", "", false},
+		{"[Group] Show - 01 [ABCD123].mkv", "", false},
+	}
+
+	for _, tt := range tests {
+		result, ok := filenameChecksum(tt.input)
+		if result != tt.expected || ok != tt.ok {
+			t.Errorf("filenameChecksum(%q) = %q, %v, want %q, %v", tt.input, result, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestChecksummerVerify(t *testing.T) {
+	sums := newChecksummer()
+	sums.Write([]byte("hello world"))
+
+	tests := []struct {
+		name     string
+		expected map[ChecksumAlgorithm]string
+		status   VerificationStatus
+		algo     ChecksumAlgorithm
+	}{
+		{"unverified", map[ChecksumAlgorithm]string{}, VerificationUnverified, ChecksumSHA256},
+		{"crc32", map[ChecksumAlgorithm]string{ChecksumCRC32: "0d4a1185"}, VerificationVerified, ChecksumCRC32},
+		{"strongest match", map[ChecksumAlgorithm]string{
+			ChecksumCRC32: "0d4a1185",
+			ChecksumMD5:   "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		}, VerificationVerified, ChecksumMD5},
+		{"any mismatch", map[ChecksumAlgorithm]string{
+			ChecksumCRC32: "00000000",
+			ChecksumMD5:   "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		}, VerificationMismatch, ChecksumCRC32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sums.verify(tt.expected)
+			if result.Status != tt.status || result.Algorithm != tt.algo {
+				t.Errorf("verify() = %s %s, want %s %s", result.Status, result.Algorithm, tt.status, tt.algo)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package xdcc
+
+import "strings"
+
+// tokenizeCTCP splits the arguments of a CTCP message on spaces. An
+// argument in double quotes may contain spaces, it ends at the first quote
+// followed by a space; the quotes are removed. An unterminated quote runs
+// to the end of the message.
+func tokenizeCTCP(text string) []string {
+	var args []string
+	for {
+		text = strings.TrimLeft(text, " ")
+		if text == "" {
+			return args
+		}
+
+		if text[0] != '"' {
+			end := strings.IndexByte(text, ' ')
+			if end < 0 {
+				return append(args, text)
+			}
+			args = append(args, text[:end])
+			text = text[end:]
+			continue
+		}
+
+		text = text[1:]
+		end := closingQuote(text)
+		if end < 0 {
+			return append(args, text)
+		}
+		args = append(args, text[:end])
+		text = text[end+1:]
+	}
+}
+
+// closingQuote returns the index of the first quote followed by a space or
+// the end of text, -1 if there is none.
+func closingQuote(text string) int {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '"' && (i+1 == len(text) || text[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// quoteCTCPArg quotes an argument containing spaces, such as a file name.
+func quoteCTCPArg(arg string) string {
+	if arg == "" || strings.ContainsRune(arg, ' ') {
+		return `"` + arg + `"`
+	}
+	return arg
+}
@@ -0,0 +1,174 @@
+package xdcc
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeCTCP(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"SEND file.bin 3232235777 5000 1024", []string{"SEND", "file.bin", "3232235777", "5000", "1024"}},
+		{"SEND  file.bin   1 2", []string{"SEND", "file.bin", "1", "2"}},
+		{`SEND "my file.bin" 1 2 3`, []string{"SEND", "my file.bin", "1", "2", "3"}},
+		{`SEND "say "hi".txt" 1 2`, []string{"SEND", `say "hi".txt`, "1", "2"}},
+		{`SEND "" 1 2`, []string{"SEND", "", "1", "2"}},
+		{`SEND "unterminated name`, []string{"SEND", "unterminated name"}},
+		{`SEND a"b 1`, []string{"SEND", `a"b`, "1"}},
+	}
+
+	for _, test := range tests {
+		if got := tokenizeCTCP(test.input); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("tokenizeCTCP(%q) = %q, want %q", test.input, got, test.expected)
+		}
+	}
+}
+
+func TestParseCTCPRes(t *testing.T) {
+	ip := net.IPv4(192, 168, 1, 1)
+	tests := []struct {
+		name     string
+		input    string
+		expected CTCPResponse
+		wantErr  bool
+	}{
+		{
+			name:     "send",
+			input:    "SEND file.bin 3232235777 5000 1024",
+			expected: &XdccSendRes{FileName: "file.bin", IP: ip, Port: 5000, FileSize: 1024},
+		},
+		{
+			name:     "quoted name",
+			input:    `SEND "my file.bin" 3232235777 5000 1024`,
+			expected: &XdccSendRes{FileName: "my file.bin", IP: ip, Port: 5000, FileSize: 1024},
+		},
+		{
+			name:     "unquoted name with spaces",
+			input:    "SEND my file.bin 3232235777 5000 1024",
+			expected: &XdccSendRes{FileName: "my file.bin", IP: ip, Port: 5000, FileSize: 1024},
+		},
+		{
+			name:     "without size",
+			input:    "SEND file.bin 3232235777 5000",
+			expected: &XdccSendRes{FileName: "file.bin", IP: ip, Port: 5000},
+		},
+		{
+			name:     "name ending like a hostname",
+			input:    "SEND my show.mkv 3232235777 5000",
+			expected: &XdccSendRes{FileName: "my show.mkv", IP: ip, Port: 5000},
+		},
+		{
+			name:     "name ending like an address",
+			input:    "SEND Show 01 3232235777 5000",
+			expected: &XdccSendRes{FileName: "Show 01", IP: ip, Port: 5000},
+		},
+		{
+			name:     "passive",
+			input:    `SEND "my file.bin" 3232235777 0 1024 42`,
+			expected: &XdccSendRes{FileName: "my file.bin", IP: ip, Port: 0, FileSize: 1024, Token: "42"},
+		},
+		{
+			name:     "hostname",
+			input:    "SEND file.bin bot.example.org 5000 1024",
+			expected: &XdccSendRes{FileName: "file.bin", Host: "bot.example.org", Port: 5000, FileSize: 1024},
+		},
+		{
+			name:     "ssend",
+			input:    "SSEND file.bin 3232235777 5000 1024",
+			expected: &XdccSendRes{FileName: "file.bin", IP: ip, Port: 5000, FileSize: 1024, Secure: true},
+		},
+		{
+			name:     "tsend",
+			input:    "tsend file.bin 3232235777 5000 1024",
+			expected: &XdccSendRes{FileName: "file.bin", IP: ip, Port: 5000, FileSize: 1024, Turbo: true},
+		},
+		{
+			name:     "accept",
+			input:    `ACCEPT "my file.bin" 5000 512`,
+			expected: &XdccAcceptRes{FileName: "my file.bin", Port: 5000, Position: 512},
+		},
+		{
+			name:     "passive accept",
+			input:    "ACCEPT file.bin 0 512 42",
+			expected: &XdccAcceptRes{FileName: "file.bin", Port: 0, Position: 512, Token: "42"},
+		},
+		{name: "chat is ignored", input: "CHAT chat 3232235777 5000"},
+		{name: "empty", input: ""},
+		{name: "missing arguments", input: "SEND file.bin", wantErr: true},
+		{name: "invalid port", input: "SEND file.bin 3232235777 70000 1024", wantErr: true},
+		{name: "negative size", input: "SEND file.bin 3232235777 5000 -1", wantErr: true},
+		{name: "active port 0", input: "SEND file.bin 3232235777 0 1024", wantErr: true},
+		{name: "empty name", input: `SEND "" 3232235777 5000 1024`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseCTCPRes(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got %+v, want %+v", got, test.expected)
+			}
+		})
+	}
+}
+
+func FuzzXdccSendResParse(f *testing.F) {
+	for _, seed := range []string{
+		"file.bin 3232235777 5000 1024",
+		`"my file.bin" 3232235777 5000 1024`,
+		"my file.bin ::1 5000",
+		"file.bin 3232235777 0 1024 42",
+		`"unterminated 0 0 0`,
+		"file.bin bot.example.org 65535 0",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		var send XdccSendRes
+		if err := send.Parse(tokenizeCTCP(text)); err != nil {
+			return
+		}
+		if send.FileName == "" {
+			t.Fatalf("%q: empty file name", text)
+		}
+		if send.Port < 0 || send.Port > 65535 || send.FileSize < 0 {
+			t.Fatalf("%q: invalid offer %+v", text, send)
+		}
+		if send.IsPassive() != (send.Port == 0) {
+			t.Fatalf("%q: port 0 without a token", text)
+		}
+		if (send.IP == nil) == (send.Host == "") {
+			t.Fatalf("%q: invalid address %+v", text, send)
+		}
+
+		// the reply to a passive offer must keep the name whole
+		req := &XdccPassiveSendReq{
+			FileName: send.FileName,
+			IP:       net.IPv4(10, 0, 0, 1),
+			Port:     5000,
+			FileSize: send.FileSize,
+			Token:    send.Token,
+		}
+		if !send.IsPassive() || strings.ContainsAny(send.Token, `" `) || strings.ContainsRune(send.FileName, '"') {
+			return
+		}
+		if args := tokenizeCTCP(req.String()); len(args) != 6 || args[1] != send.FileName {
+			t.Fatalf("%q: round trip gave %q", req.String(), args)
+		}
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package xdcc
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
+
+func isNoSpace(err error) bool {
+	return false
+}
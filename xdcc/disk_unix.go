@@ -0,0 +1,24 @@
+//go:build unix
+
+package xdcc
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the bytes available to the user on the filesystem of dir.
+func freeSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// isNoSpace reports whether err means the filesystem is full.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
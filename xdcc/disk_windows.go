@@ -0,0 +1,28 @@
+//go:build windows
+
+package xdcc
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// freeSpace returns the bytes available to the user on the volume of dir.
+func freeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// isNoSpace reports whether err means the filesystem is full.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,77 @@
+package xdcc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// ErrorType categorises transfer failures, it is reported as the
+// ErrorType of a TransferErrorEvent.
+type ErrorType string
+
+const (
+	ErrorTypeNetwork  ErrorType = "network"
+	ErrorTypeIRC      ErrorType = "irc"
+	ErrorTypeFile     ErrorType = "file"
+	ErrorTypeParse    ErrorType = "parse"
+	ErrorTypeSSL      ErrorType = "ssl"
+	ErrorTypeBot      ErrorType = "bot"
+	ErrorTypeTimeout  ErrorType = "timeout"
+	ErrorTypeAuth     ErrorType = "auth"
+	ErrorTypeChannel  ErrorType = "channel"
+	ErrorTypeChecksum ErrorType = "checksum"
+	ErrorTypeOffer    ErrorType = "offer"
+	ErrorTypeUnknown  ErrorType = "unknown"
+)
+
+// TransferError is an error that affects a single transfer.
+type TransferError struct {
+	Type ErrorType
+	Err  error
+}
+
+func (e *TransferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+func newTransferError(errType ErrorType, err error) *TransferError {
+	return &TransferError{Type: errType, Err: err}
+}
+
+// errorTypeOf returns the category of err, ErrorTypeUnknown if it
+// is not a TransferError.
+func errorTypeOf(err error) ErrorType {
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return transferErr.Type
+	}
+	return ErrorTypeUnknown
+}
+
+// classifyConnectError wraps an error returned while connecting to the
+// IRC server: TLS handshake and certificate failures are ssl errors,
+// anything else is a network error.
+func classifyConnectError(err error) *TransferError {
+	var (
+		certErr      *tls.CertificateVerificationError
+		unknownAuth  x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidCert  x509.CertificateInvalidError
+		recordHdrErr tls.RecordHeaderError
+		alertErr     tls.AlertError
+		pinErr       *CertificatePinError
+	)
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCert),
+		errors.As(err, &recordHdrErr), errors.As(err, &alertErr),
+		errors.As(err, &pinErr):
+		return newTransferError(ErrorTypeSSL, err)
+	}
+	return newTransferError(ErrorTypeNetwork, err)
+}
@@ -1,11 +1,14 @@
 package xdcc
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/text/runes"
 	"golang.org/x/text/transform"
@@ -67,6 +70,161 @@ func SanitizeFilename(filename string) string {
 	return sanitized
 }
 
+// FilenamePolicy turns the name offered by a bot into the name of the
+// downloaded file. Whatever the policy, the result is then made safe: path
+// separators, control characters and leading dots are replaced or removed,
+// and long names are shortened.
+type FilenamePolicy interface {
+	Sanitize(name string) string
+}
+
+// FilenameStyle selects the characters kept by StandardFilenamePolicy.
+type FilenameStyle string
+
+const (
+	// FilenameUnicodePreserving keeps the name as offered, apart from the
+	// characters that are never safe.
+	FilenameUnicodePreserving FilenameStyle = "unicode-preserving"
+	// FilenamePOSIXSafe keeps the POSIX portable characters [A-Za-z0-9._-].
+	FilenamePOSIXSafe FilenameStyle = "posix-safe"
+	// FilenameWindowsSafe also avoids the characters and device names
+	// reserved by Windows, and trailing dots and spaces.
+	FilenameWindowsSafe FilenameStyle = "windows-safe"
+	// FilenameASCIIOnly transliterates the name, see SanitizeFilename.
+	FilenameASCIIOnly FilenameStyle = "ascii-only"
+)
+
+var ErrInvalidFilenameStyle = errors.New("invalid filename style")
+
+func ParseFilenameStyle(s string) (FilenameStyle, error) {
+	switch style := FilenameStyle(s); style {
+	case "":
+		return FilenameUnicodePreserving, nil
+	case FilenameUnicodePreserving, FilenamePOSIXSafe, FilenameWindowsSafe, FilenameASCIIOnly:
+		return style, nil
+	}
+	return "", ErrInvalidFilenameStyle
+}
+
+// DefaultMaxFilenameBytes leaves room in the 255 bytes most filesystems
+// allow for the part suffix and the -N added by GetUniqueFilePath.
+const DefaultMaxFilenameBytes = 240
+
+// maxFilenameBytes is the longest name whatever the policy.
+const maxFilenameBytes = 255 - len(PartFileSuffix)
+
+// StandardFilenamePolicy is the FilenamePolicy used by default, with the
+// FilenameUnicodePreserving style.
+type StandardFilenamePolicy struct {
+	Style FilenameStyle
+	// MaxBytes is the longest name in bytes of UTF-8, names are shortened
+	// keeping their extension. Defaults to DefaultMaxFilenameBytes.
+	MaxBytes int
+}
+
+func (p StandardFilenamePolicy) Sanitize(name string) string {
+	maxBytes := p.MaxBytes
+	if maxBytes <= 0 || maxBytes > maxFilenameBytes {
+		maxBytes = DefaultMaxFilenameBytes
+	}
+	name = safeFilename(name, maxBytes)
+
+	switch p.Style {
+	case FilenamePOSIXSafe:
+		return posixSafeFilename(name)
+	case FilenameWindowsSafe:
+		return windowsSafeFilename(name)
+	case FilenameASCIIOnly:
+		return SanitizeFilename(name)
+	}
+	return name
+}
+
+// safeFilename makes name usable as the name of a file in the output
+// folder: it cannot contain path separators or control characters, start
+// with a dot or be longer than maxBytes.
+func safeFilename(name string, maxBytes int) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// hidden files, "." and "..", also behind spaces as in ". .bashrc"
+	name = truncateFilename(name, maxBytes)
+	for trimmed := ""; trimmed != name; {
+		trimmed = name
+		name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	}
+	if name == "" {
+		return "unnamed_file"
+	}
+	return name
+}
+
+// truncateFilename shortens name to maxBytes on a character boundary,
+// keeping its extension.
+func truncateFilename(name string, maxBytes int) string {
+	if len(name) <= maxBytes {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxBytes/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	limit := maxBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return stem[:limit] + ext
+}
+
+func posixSafeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	for strings.Contains(name, "__") {
+		name = strings.ReplaceAll(name, "__", "_")
+	}
+	return name
+}
+
+var windowsReservedRegexp = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9¹²³]|lpt[0-9¹²³])(\.|$)`)
+
+func windowsSafeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	// "CON.txt" is the console whatever the extension
+	if m := windowsReservedRegexp.FindStringSubmatchIndex(name); m != nil {
+		name = name[:m[3]] + "_" + name[m[3]:]
+	}
+	if name == "" {
+		return "unnamed_file"
+	}
+	return name
+}
+
+// PartFileSuffix is appended to the name of a file until it is completely
+// downloaded, so that partial files are never mistaken for complete ones.
+const PartFileSuffix = ".part"
+
+// PartFilePath returns where the file at path is written while downloading.
+func PartFilePath(path string) string {
+	return path + PartFileSuffix
+}
+
 // GetUniqueFilePath returns a unique file path by adding a numeric suffix if the file exists.
 // Examples:
 //   file.mp3 -> file.mp3 (if doesn't exist)
@@ -92,3 +250,68 @@ func GetUniqueFilePath(basePath string) string {
 		}
 	}
 }
+
+// ExistsPolicy tells what to do when the file offered by the bot already
+// exists in the output folder.
+type ExistsPolicy string
+
+const (
+	// ExistsRename downloads the file under another name, see GetUniqueFilePath.
+	ExistsRename ExistsPolicy = "rename"
+	// ExistsSkip does not download a file of the offered size again,
+	// other files are renamed.
+	ExistsSkip ExistsPolicy = "skip"
+	// ExistsOverwrite replaces the file once the download is complete.
+	ExistsOverwrite ExistsPolicy = "overwrite"
+	// ExistsResume continues a smaller file and skips one of the offered
+	// size, other files are renamed.
+	ExistsResume ExistsPolicy = "resume"
+)
+
+var ErrInvalidExistsPolicy = errors.New("invalid exists policy")
+
+func ParseExistsPolicy(s string) (ExistsPolicy, error) {
+	switch policy := ExistsPolicy(s); policy {
+	case "":
+		return ExistsRename, nil
+	case ExistsRename, ExistsSkip, ExistsOverwrite, ExistsResume:
+		return policy, nil
+	}
+	return "", ErrInvalidExistsPolicy
+}
+
+// target returns the path to download a file of the given size to, when
+// path is where it should go. skip is set when the file on disk is
+// already the offered one.
+func (policy ExistsPolicy) target(path string, size int) (target string, skip bool, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return path, false, nil
+	}
+	regular := info.Mode().IsRegular()
+	complete := regular && info.Size() == int64(size)
+
+	switch policy {
+	case ExistsSkip:
+		if complete {
+			return path, true, nil
+		}
+	case ExistsOverwrite:
+		return path, false, nil
+	case ExistsResume:
+		if complete {
+			return path, true, nil
+		}
+		if regular && info.Size() < int64(size) {
+			// the file becomes the partial download, unless there is one already
+			if _, err := os.Stat(PartFilePath(path)); err == nil {
+				return path, false, nil
+			}
+			if err := os.Rename(path, PartFilePath(path)); err != nil {
+				return "", false, err
+			}
+			return path, false, nil
+		}
+	}
+	return GetUniqueFilePath(path), false, nil
+}
@@ -3,6 +3,7 @@ package xdcc
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -176,3 +177,94 @@ func TestGetUniqueFilePath(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedMultiDot, result)
 	}
 }
+
+func TestExistsPolicyTarget(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "xdcc-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "file.mkv")
+	renamed := filepath.Join(tmpDir, "file-1.mkv")
+
+	tests := []struct {
+		name     string
+		policy   ExistsPolicy
+		size     int
+		expected string
+		skip     bool
+	}{
+		{"rename", ExistsRename, 4, renamed, false},
+		{"skip same size", ExistsSkip, 4, path, true},
+		{"skip other size", ExistsSkip, 10, renamed, false},
+		{"overwrite", ExistsOverwrite, 4, path, false},
+		{"resume same size", ExistsResume, 4, path, true},
+		{"resume larger file", ExistsResume, 2, renamed, false},
+		{"resume smaller file", ExistsResume, 10, path, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte("test"), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+			defer os.Remove(PartFilePath(path))
+
+			target, skip, err := tt.policy.target(path, tt.size)
+			if err != nil {
+				t.Fatalf("target() error: %v", err)
+			}
+			if target != tt.expected || skip != tt.skip {
+				t.Errorf("target() = %s, %v, want %s, %v", target, skip, tt.expected, tt.skip)
+			}
+		})
+	}
+
+	// a smaller file to resume becomes the part file
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be renamed to its part file", path)
+	}
+}
+
+func TestStandardFilenamePolicy(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".mkv"
+
+	tests := []struct {
+		name     string
+		style    FilenameStyle
+		input    string
+		expected string
+	}{
+		{"path traversal", FilenameUnicodePreserving, "../../.bashrc", "_.._.bashrc"},
+		{"absolute path", FilenameUnicodePreserving, "/etc/passwd", "_etc_passwd"},
+		{"windows separator", FilenameUnicodePreserving, `..\..\evil.exe`, "_.._evil.exe"},
+		{"hidden file", FilenameUnicodePreserving, ".hidden", "hidden"},
+		{"dot dot", FilenameUnicodePreserving, "..", "unnamed_file"},
+		{"hidden file behind a dot", FilenameUnicodePreserving, ". .bashrc", "bashrc"},
+		{"hidden file behind a space", FilenameUnicodePreserving, " ..x", "x"},
+		{"dots and spaces only", FilenameUnicodePreserving, " . . ", "unnamed_file"},
+		{"control characters", FilenameUnicodePreserving, "file\x00name\n.mkv", "file_name_.mkv"},
+		{"invalid utf-8", FilenameUnicodePreserving, "file\xff.mkv", "file_.mkv"},
+		{"unicode kept", FilenameUnicodePreserving, "日本語 [Group].mkv", "日本語 [Group].mkv"},
+		{"long name", FilenameUnicodePreserving, long, strings.Repeat("é", 118) + ".mkv"},
+		{"posix", FilenamePOSIXSafe, "My File (1080p) [é].mkv", "My_File_1080p_.mkv"},
+		{"windows reserved characters", FilenameWindowsSafe, `what?: "a|b".mkv`, "what__ _a_b_.mkv"},
+		{"windows trailing dots", FilenameWindowsSafe, "file. . ", "file"},
+		{"windows device name", FilenameWindowsSafe, "CON.txt", "CON_.txt"},
+		{"windows device prefix", FilenameWindowsSafe, "console.txt", "console.txt"},
+		{"ascii", FilenameASCIIOnly, "../Café.mkv", "_Cafe.mkv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := StandardFilenamePolicy{Style: tt.style}.Sanitize(tt.input)
+			if result != tt.expected {
+				t.Errorf("Sanitize(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+			if len(result) > DefaultMaxFilenameBytes {
+				t.Errorf("Sanitize(%q) is %d bytes long", tt.input, len(result))
+			}
+		})
+	}
+}
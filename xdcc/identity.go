@@ -0,0 +1,90 @@
+package xdcc
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NickRandPlaceholder is replaced by random digits in Identity.Nick.
+const NickRandPlaceholder = "{rand}"
+
+// Identity is how the client presents itself on IRC networks.
+type Identity struct {
+	// Nick is a template of the nickname, see NickRandPlaceholder. When
+	// the nick is taken, the template is expanded again or, without the
+	// placeholder, digits are appended to it.
+	Nick string
+	// Ident is the user name of the hostmask, servers prefix it with "~"
+	// when identd does not confirm it.
+	Ident string
+	// RealName is shown by WHOIS.
+	RealName string
+	// Version is the reply to CTCP VERSION.
+	Version string
+}
+
+// DefaultIdentity provides the fields of Config.Identity left empty.
+var DefaultIdentity = Identity{
+	Nick:     IRCClientUserName + NickRandPlaceholder,
+	Ident:    IRCClientUserName,
+	RealName: IRCClientUserName,
+	Version:  IRCClientUserName,
+}
+
+func (id Identity) withDefaults() Identity {
+	if id.Nick == "" {
+		id.Nick = DefaultIdentity.Nick
+	}
+	if id.Ident == "" {
+		id.Ident = DefaultIdentity.Ident
+	}
+	if id.RealName == "" {
+		id.RealName = DefaultIdentity.RealName
+	}
+	if id.Version == "" {
+		id.Version = DefaultIdentity.Version
+	}
+	return id
+}
+
+func randomDigits() string {
+	return strconv.Itoa(int(rand.Uint32()))
+}
+
+// nick expands the nickname template.
+func (id Identity) nick() string {
+	return strings.ReplaceAll(id.Nick, NickRandPlaceholder, randomDigits())
+}
+
+// newNick returns the nick to try when the given one is taken.
+func (id Identity) newNick(taken string) string {
+	if strings.Contains(id.Nick, NickRandPlaceholder) {
+		return id.nick()
+	}
+	return taken + randomDigits()
+}
+
+// CTCP queries answered to other users. VERSION and PING are answered by
+// the IRC library, from Identity.Version for the former.
+const (
+	CLIENTINFO = "CLIENTINFO"
+	PING       = "PING"
+	TIME       = "TIME"
+)
+
+// ctcpQueries lists the queries replied to CLIENTINFO.
+var ctcpQueries = []string{CLIENTINFO, DCC, PING, TIME, VERSION}
+
+// ctcpReply returns the reply to a CTCP query, false if it is not
+// answered here.
+func ctcpReply(query string) (string, bool) {
+	switch query {
+	case CLIENTINFO:
+		return strings.Join(ctcpQueries, " "), true
+	case TIME:
+		return time.Now().Format(time.ANSIC), true
+	}
+	return "", false
+}
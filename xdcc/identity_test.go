@@ -0,0 +1,122 @@
+package xdcc
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdentityNick(t *testing.T) {
+	tests := []struct {
+		template string
+		taken    string
+		nick     string
+		newNick  string
+	}{
+		{template: "leech{rand}", taken: "leech123", nick: `^leech\d+$`, newNick: `^leech\d+$`},
+		{template: "{rand}x{rand}", taken: "1x1", nick: `^(\d+)x(\d+)$`, newNick: `^(\d+)x(\d+)$`},
+		{template: "leech", taken: "leech", nick: `^leech$`, newNick: `^leech\d+$`},
+		{template: "leech", taken: "leech42", nick: `^leech$`, newNick: `^leech42\d+$`},
+	}
+
+	for _, test := range tests {
+		id := Identity{Nick: test.template}
+		if nick := id.nick(); !regexp.MustCompile(test.nick).MatchString(nick) {
+			t.Errorf("%q: nick() = %q, want %s", test.template, nick, test.nick)
+		}
+		if nick := id.newNick(test.taken); !regexp.MustCompile(test.newNick).MatchString(nick) || nick == test.taken {
+			t.Errorf("%q: newNick(%q) = %q, want %s", test.template, test.taken, nick, test.newNick)
+		}
+	}
+
+	// every placeholder gets the same digits
+	nick := Identity{Nick: "{rand}x{rand}"}.nick()
+	if parts := strings.Split(nick, "x"); parts[0] != parts[1] {
+		t.Errorf("nick() = %q, want the same digits on both sides", nick)
+	}
+}
+
+func TestCTCPReply(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		ok       bool
+	}{
+		{CLIENTINFO, "CLIENTINFO DCC PING TIME VERSION", true},
+		// answered by the IRC library
+		{VERSION, "", false},
+		{PING, "", false},
+		{"FINGER", "", false},
+	}
+
+	for _, test := range tests {
+		reply, ok := ctcpReply(test.query)
+		if reply != test.expected || ok != test.ok {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.query, reply, ok, test.expected, test.ok)
+		}
+	}
+
+	reply, ok := ctcpReply(TIME)
+	if now, err := time.Parse(time.ANSIC, reply); !ok || err != nil || time.Since(now) > time.Minute {
+		t.Errorf("%q: got %q, %v, want the current time", TIME, reply, ok)
+	}
+}
+
+func TestSessionIdentity(t *testing.T) {
+	// the flood control of the client spaces the replies out by seconds
+	t.Parallel()
+	queries := []string{
+		":irc.test 001 $nick :Welcome",
+		":user!u@h PRIVMSG $nick :\x01VERSION\x01",
+		":user!u@h PRIVMSG $nick :\x01PING 12345\x01",
+		":user!u@h PRIVMSG $nick :\x01TIME\x01",
+		":user!u@h PRIVMSG $nick :\x01CLIENTINFO\x01",
+	}
+	// the first nick is taken, the server welcomes the next one
+	port, lines := fakeIRCServer(t, map[string][]string{
+		"NICK leech": {},
+		"USER":       {":irc.test 433 * $nick :Nickname is already in use"},
+		"NICK":       queries,
+	})
+
+	transfer := newXdccTransfer(Config{
+		File:     IRCFile{Network: "127.0.0.1", Port: port, Channel: "#chan", UserName: "Bot", Slot: 1},
+		TLS:      TLSPolicy{Security: TLSPlaintextAllowed},
+		Retry:    RetryPolicy{MaxAttempts: 1, TLSModes: []TLSMode{TLSModePlain}},
+		Identity: Identity{Nick: "leech", Ident: "ident", RealName: "Real Name", Version: "leech 1.0"},
+	})
+	t.Cleanup(func() { transfer.Cancel(context.Background()) })
+	if err := transfer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[*regexp.Regexp]bool{
+		regexp.MustCompile(`^USER ident \S+ \S+ :Real Name$`):                 false,
+		regexp.MustCompile(`^NICK :?leech\d+$`):                               false,
+		regexp.MustCompile("^NOTICE user :\x01VERSION leech 1.0\x01$"):        false,
+		regexp.MustCompile("^NOTICE user :\x01PING 12345\x01$"):               false,
+		regexp.MustCompile("^NOTICE user :\x01TIME .+\x01$"):                  false,
+		regexp.MustCompile("^NOTICE user :\x01CLIENTINFO CLIENTINFO .+\x01$"): false,
+	}
+	timeout := time.After(20 * time.Second)
+	for missing := len(expected); missing > 0; {
+		select {
+		case line := <-lines:
+			for pattern, seen := range expected {
+				if !seen && pattern.MatchString(line) {
+					expected[pattern] = true
+					missing--
+				}
+			}
+		case <-timeout:
+			for pattern, seen := range expected {
+				if !seen {
+					t.Errorf("client did not send %q", pattern)
+				}
+			}
+			return
+		}
+	}
+}
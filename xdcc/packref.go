@@ -0,0 +1,140 @@
+package xdcc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"xdcc-cli/util"
+)
+
+var (
+	// xdccCommandRegexp matches the commands users copy from search sites
+	// and channels, like "/msg Bot xdcc send #42"
+	xdccCommandRegexp = regexp.MustCompile(`(?i)^/(?:msg|ctcp)\s+(\S+)\s+xdcc\s+(?:send|get|batch)\s+(\S+)$`)
+	// channelLinkRegexp matches a command preceded by the channel link of
+	// a search site, like "irc://irc.rizon.net/news /msg Bot xdcc send #42"
+	channelLinkRegexp = regexp.MustCompile(`^(ircs?://[^/\s]+/[^/\s]+)/?\s+(/.+)$`)
+	// searchRowRegexp matches a search result copied from a search site:
+	// network, channel, bot and pack, possibly followed by other columns
+	searchRowRegexp = regexp.MustCompile(`^([^\s/]+)\s+(#\S+)\s+(\S+)\s+(#\d+)(?:\s|$)`)
+	// sizeColumnRegexp matches the size column of a search result, the
+	// download count before it has no unit
+	sizeColumnRegexp = regexp.MustCompile(`(?i)^\d+(?:\.\d+)?[KMGT]i?B?$`)
+)
+
+// BotDirectory locates the bots of the pack references that do not name
+// their network, like "/msg Bot xdcc send #42".
+type BotDirectory struct {
+	// Network and Channel locate the bots missing from Bots. The network
+	// may include a port.
+	Network string
+	Channel string
+	// Bots is keyed by lower-case bot name, see LoadBots.
+	Bots map[string]IRCBot
+}
+
+// LoadBots reads where bots are, one bot per line:
+//
+//	<bot> <network[:port]> <channel>
+//
+// Empty lines and lines starting with # are ignored. The returned map is
+// keyed by lower-case bot name.
+func LoadBots(path string) (map[string]IRCBot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bots := map[string]IRCBot{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected a bot, a network and a channel", path, lineNum)
+		}
+		bots[strings.ToLower(fields[0])] = IRCBot{Network: fields[1], Channel: fields[2], Name: fields[0]}
+	}
+	return bots, scanner.Err()
+}
+
+func (d *BotDirectory) locate(bot string) (IRCBot, bool) {
+	if location, ok := d.Bots[strings.ToLower(bot)]; ok {
+		return location, true
+	}
+	if d.Network == "" || d.Channel == "" {
+		return IRCBot{}, false
+	}
+	return IRCBot{Network: d.Network, Channel: d.Channel, Name: bot}, true
+}
+
+func parseXdccCommand(command string) (string, string, error) {
+	m := xdccCommandRegexp.FindStringSubmatch(strings.TrimSpace(command))
+	if m == nil {
+		return "", "", invalidURL("unrecognized command %q", command)
+	}
+	return m[1], m[2], nil
+}
+
+func packsURL(network string, channel string, bot string, slots string) string {
+	return fmt.Sprintf("irc://%s/%s/%s/%s", network, escapeURLElement(channel), escapeURLElement(bot), slots)
+}
+
+// ParsePacks parses a reference to packs: an IRC URL (see ParsePacksURL),
+// a "/msg Bot xdcc send #42" command, possibly preceded by the channel
+// link of a search site, or a search result row starting with the
+// network, channel, bot and pack. Commands without a channel link are
+// located with the directory.
+func (d *BotDirectory) ParsePacks(input string) (*IRCPacks, error) {
+	input = strings.TrimSpace(input)
+
+	if m := channelLinkRegexp.FindStringSubmatch(input); m != nil {
+		bot, slots, err := parseXdccCommand(m[2])
+		if err != nil {
+			return nil, err
+		}
+		return ParsePacksURL(m[1] + "/" + escapeURLElement(bot) + "/" + slots)
+	}
+
+	if strings.HasPrefix(input, "/") {
+		bot, slots, err := parseXdccCommand(input)
+		if err != nil {
+			return nil, err
+		}
+		location, ok := d.locate(bot)
+		if !ok {
+			return nil, invalidURL("network of bot %s unknown", bot)
+		}
+		return ParsePacksURL(packsURL(location.Network, location.Channel, bot, slots))
+	}
+
+	if m := searchRowRegexp.FindStringSubmatch(input); m != nil {
+		packs, err := ParsePacksURL(packsURL(m[1], m[2], m[3], m[4]))
+		if err != nil {
+			return nil, err
+		}
+		packs.Size = searchRowSize(input[len(m[0]):])
+		return packs, nil
+	}
+	return ParsePacksURL(input)
+}
+
+// searchRowSize returns the size in the columns following the pack of a
+// search result row, zero if there is none.
+func searchRowSize(columns string) int64 {
+	for _, column := range strings.Fields(columns) {
+		if !sizeColumnRegexp.MatchString(column) {
+			continue
+		}
+		if size, err := util.ParseByteSize(column); err == nil {
+			return size
+		}
+	}
+	return 0
+}
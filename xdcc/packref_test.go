@@ -0,0 +1,55 @@
+package xdcc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePacks(t *testing.T) {
+	directory := BotDirectory{
+		Network: "irc.rizon.net",
+		Channel: "#news",
+		Bots: map[string]IRCBot{
+			"[xdcc]other": {Network: "irc.abjects.net:6697", Channel: "#moviegods", Name: "[XDCC]Other"},
+		},
+	}
+	tests := []struct {
+		input    string
+		expected string
+		size     int64
+	}{
+		{"irc://irc.rizon.net/news/Bot/42", "irc://irc.rizon.net/#news/Bot/42", 0},
+		{"/msg [XDCC]Bot xdcc send #42", "irc://irc.rizon.net/#news/[XDCC]Bot/42", 0},
+		{"  /MSG Bot XDCC GET 7  ", "irc://irc.rizon.net/#news/Bot/7", 0},
+		{"/ctcp Bot xdcc batch 1-3,#9", "irc://irc.rizon.net/#news/Bot/1-3,9", 0},
+		{"/msg [xdcc]OTHER xdcc send #5", "irc://irc.abjects.net:6697/#moviegods/[xdcc]OTHER/5", 0},
+		{"ircs://irc.rizon.net/horriblesubs /msg Bot xdcc send #3", "ircs://irc.rizon.net/#horriblesubs/Bot/3", 0},
+		{"irc.scenep2p.net #THE.SOURCE Bot #12 150 1.2G Some.File.mkv", "irc://irc.scenep2p.net/#THE.SOURCE/Bot/12", 1288490188},
+		{"irc.rizon.net #news Bot #42 700MB file.mkv", "irc://irc.rizon.net/#news/Bot/42", 700 << 20},
+		{"irc.rizon.net #news Bot #42 file.mkv", "irc://irc.rizon.net/#news/Bot/42", 0},
+	}
+
+	for _, test := range tests {
+		packs, err := directory.ParsePacks(test.input)
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if got := packs.String(); got != test.expected {
+			t.Errorf("%q: got %s, want %s", test.input, got, test.expected)
+		}
+		if packs.Size != test.size {
+			t.Errorf("%q: got size %d, want %d", test.input, packs.Size, test.size)
+		}
+	}
+
+	for _, input := range []string{"/msg Bot xdcc list", "/msg Bot xdcc send", "/join #news", "Bot #42"} {
+		if _, err := directory.ParsePacks(input); !errors.Is(err, ErrInvalidURL) {
+			t.Errorf("%q: got %v, want ErrInvalidURL", input, err)
+		}
+	}
+
+	if _, err := (&BotDirectory{}).ParsePacks("/msg Bot xdcc send #1"); !errors.Is(err, ErrInvalidURL) {
+		t.Errorf("unknown bot: got %v, want ErrInvalidURL", err)
+	}
+}
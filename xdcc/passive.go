@@ -0,0 +1,101 @@
+package xdcc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// passiveAcceptTimeout is how long we wait for a bot to connect back
+// after answering a passive DCC offer.
+const passiveAcceptTimeout = 2 * time.Minute
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+var ErrInvalidPortRange = errors.New("invalid port range")
+
+// ParsePortRange parses either a single port ("5000") or a range ("5000-5010").
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
+
+	minStr, maxStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		maxStr = minStr
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil {
+		return PortRange{}, ErrInvalidPortRange
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil {
+		return PortRange{}, ErrInvalidPortRange
+	}
+
+	if min <= 0 || max > 65535 || min > max {
+		return PortRange{}, ErrInvalidPortRange
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Listen opens a TCP listener on the first free port of the range.
+func (r PortRange) Listen() (net.Listener, error) {
+	if r.Min == 0 {
+		return net.Listen("tcp", ":0")
+	}
+
+	for port := r.Min; port <= r.Max; port++ {
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in range %s", r)
+}
+
+func acceptTimeout(listener net.Listener, timeout time.Duration) (net.Conn, error) {
+	if l, ok := listener.(*net.TCPListener); ok {
+		l.SetDeadline(time.Now().Add(timeout))
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("bot did not connect back: %w", err)
+	}
+	return conn, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+}
+
+// outboundIP returns the local address used to reach the given host.
+// No packet is sent: dialing UDP only selects a route.
+func outboundIP(host string) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "6667"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,156 @@
+package xdcc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected PortRange
+		str      string
+		wantErr  bool
+	}{
+		{input: "", expected: PortRange{}, str: "0"},
+		{input: "5000", expected: PortRange{Min: 5000, Max: 5000}, str: "5000"},
+		{input: "5000-5010", expected: PortRange{Min: 5000, Max: 5010}, str: "5000-5010"},
+		{input: " 5000 - 5010 ", expected: PortRange{Min: 5000, Max: 5010}, str: "5000-5010"},
+		{input: "5000-5000", expected: PortRange{Min: 5000, Max: 5000}, str: "5000"},
+		{input: "65535", expected: PortRange{Min: 65535, Max: 65535}, str: "65535"},
+		{input: "5010-5000", wantErr: true},
+		{input: "0", wantErr: true},
+		{input: "0-10", wantErr: true},
+		{input: "70000", wantErr: true},
+		{input: "5000-70000", wantErr: true},
+		{input: "5000-", wantErr: true},
+		{input: "-5000", wantErr: true},
+		{input: "abc", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParsePortRange(test.input)
+		if test.wantErr {
+			if !errors.Is(err, ErrInvalidPortRange) {
+				t.Errorf("%q: got %+v, %v, want ErrInvalidPortRange", test.input, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("%q: got %+v, %v, want %+v", test.input, got, err, test.expected)
+		}
+		if got.String() != test.str {
+			t.Errorf("%q: String() = %q, want %q", test.input, got.String(), test.str)
+		}
+	}
+}
+
+func listenPort(t *testing.T, listener net.Listener) int {
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestPortRangeListen(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listenPort(t, busy)
+
+	// a busy port is skipped
+	listener, err := PortRange{Min: port, Max: port + 20}.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listenPort(t, listener); got <= port || got > port+20 {
+		t.Errorf("listening on %d, want a port in %d-%d", got, port+1, port+20)
+	}
+
+	if listener, err := (PortRange{Min: port, Max: port}).Listen(); err == nil {
+		listener.Close()
+		t.Error("listening on a busy port")
+	}
+
+	// no range is any free port
+	listener, err = PortRange{}.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listenPort(t, listener) == 0 {
+		t.Error("listening on port 0")
+	}
+}
+
+func TestPassiveSend(t *testing.T) {
+	// the flood control of the client delays the exchange by seconds
+	t.Parallel()
+	data := []byte("passive data")
+	offer := "\x01DCC SEND file.bin 2130706433 0 " + strconv.Itoa(len(data)) + " tok42\x01"
+	port, lines := fakeIRCServer(t, map[string][]string{
+		"USER":                      {":irc.test 001 $nick :Welcome"},
+		"JOIN #chan":                {":$nick!user@host JOIN #chan"},
+		"PRIVMSG Bot :xdcc send #1": {":Bot!bot@host PRIVMSG $nick :" + offer},
+	})
+
+	dir := t.TempDir()
+	transfer := newXdccTransfer(Config{
+		File:         IRCFile{Network: "127.0.0.1", Port: port, Channel: "#chan", UserName: "Bot", Slot: 1},
+		OutPath:      dir,
+		TLS:          TLSPolicy{Security: TLSPlaintextAllowed},
+		Retry:        RetryPolicy{MaxAttempts: 1, TLSModes: []TLSMode{TLSModePlain}},
+		AdvertisedIP: net.IPv4(127, 0, 0, 1),
+	})
+	t.Cleanup(func() { transfer.Cancel(context.Background()) })
+	if err := transfer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reply tells where to connect, with the token of the offer
+	timeout := time.After(15 * time.Second)
+	var reply []string
+	for reply == nil {
+		select {
+		case line := <-lines:
+			if text, ok := strings.CutPrefix(line, "PRIVMSG Bot :\x01DCC SEND "); ok {
+				reply = strings.Fields(strings.TrimSuffix(text, "\x01"))
+			}
+		case <-timeout:
+			t.Fatal("client did not answer the passive offer")
+		}
+	}
+	if len(reply) != 5 || reply[0] != "file.bin" || reply[1] != "2130706433" || reply[2] == "0" ||
+		reply[3] != strconv.Itoa(len(data)) || reply[4] != "tok42" {
+		t.Fatalf("got reply %q, want file.bin on 127.0.0.1 with token tok42", reply)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", reply[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(data)
+
+	if e, ok := waitFinished(t, transfer).(*TransferCompletedEvent); !ok {
+		t.Fatalf("got %+v, want the transfer completed", e)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || string(got) != string(data) {
+		t.Errorf("got file %q, %v, want %q", got, err, data)
+	}
+}
+
+func TestOutboundIP(t *testing.T) {
+	// the port of a network is not part of the host to route to
+	for _, network := range []string{"127.0.0.1", "127.0.0.1:7000"} {
+		host, _ := splitNetwork(network)
+		if ip, err := outboundIP(host); err != nil || !ip.IsLoopback() {
+			t.Errorf("%s: got %v, %v, want a loopback address", network, ip, err)
+		}
+	}
+}
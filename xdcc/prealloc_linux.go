@@ -0,0 +1,15 @@
+//go:build linux
+
+package xdcc
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves the blocks of a file of the given size. The size of
+// the file is left as is, so that a partial download is still recognized.
+func preallocate(file *os.File, size int64) error {
+	return unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+}
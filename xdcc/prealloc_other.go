@@ -0,0 +1,12 @@
+//go:build !linux
+
+package xdcc
+
+import (
+	"errors"
+	"os"
+)
+
+func preallocate(file *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,117 @@
+package xdcc
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket bounding a download speed in bytes/s. A
+// limiter can be shared by several transfers to cap their total speed, and
+// its rate can be changed while they run. It is safe for concurrent use.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// now is the clock, replaced by tests
+	now func() time.Time
+}
+
+// NewRateLimiter returns a limiter of the given rate, zero means unlimited.
+func NewRateLimiter(bytesPerSec float64) *RateLimiter {
+	return &RateLimiter{
+		rate:   math.Max(bytesPerSec, 0),
+		tokens: math.Max(bytesPerSec, 0),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Rate returns the current rate in bytes/s, zero means unlimited.
+func (l *RateLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate, it applies to the data read from now on.
+func (l *RateLimiter) SetRate(bytesPerSec float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refillLocked(l.now())
+	l.rate = math.Max(bytesPerSec, 0)
+	// the debt of the previous rate is not carried over
+	l.tokens = math.Max(math.Min(l.tokens, l.rate), 0)
+}
+
+// refillLocked adds the tokens earned since the last call, the bucket
+// holds at most one second worth of data.
+func (l *RateLimiter) refillLocked(now time.Time) {
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before they are
+// available.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refillLocked(l.now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be consumed or ctx is done.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// rateLimitedReader slows reads down to the rate of all its limiters.
+type rateLimitedReader struct {
+	reader   io.Reader
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+func newRateLimitedReader(ctx context.Context, reader io.Reader, limiters ...*RateLimiter) *rateLimitedReader {
+	active := make([]*RateLimiter, 0, len(limiters))
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+	return &rateLimitedReader{reader: reader, ctx: ctx, limiters: active}
+}
+
+func (r *rateLimitedReader) Read(buf []byte) (int, error) {
+	n, err := r.reader.Read(buf)
+	for _, limiter := range r.limiters {
+		if waitErr := limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
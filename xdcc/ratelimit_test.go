@@ -0,0 +1,161 @@
+package xdcc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestRateLimiter(rate float64) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := NewRateLimiter(rate)
+	limiter.last = clock.now
+	limiter.now = clock.Now
+	return limiter, clock
+}
+
+type rateStep struct {
+	elapsed time.Duration
+	bytes   int
+	delay   time.Duration
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		steps []rateStep
+	}{
+		{"burst of one second", 1000, []rateStep{
+			{0, 1000, 0},
+			{0, 500, 500 * time.Millisecond},
+			{0, 500, time.Second},
+		}},
+		{"refill", 1000, []rateStep{
+			{0, 1500, 500 * time.Millisecond},
+			{time.Second, 500, 0},
+			{250 * time.Millisecond, 500, 250 * time.Millisecond},
+		}},
+		{"bucket capped", 1000, []rateStep{
+			{time.Hour, 1500, 500 * time.Millisecond},
+		}},
+		{"unlimited", 0, []rateStep{
+			{0, 1 << 30, 0},
+			{0, 1 << 30, 0},
+		}},
+		{"negative is unlimited", -1, []rateStep{
+			{0, 1 << 30, 0},
+		}},
+	}
+
+	for _, test := range tests {
+		limiter, clock := newTestRateLimiter(test.rate)
+		for i, step := range test.steps {
+			clock.now = clock.now.Add(step.elapsed)
+			if delay := limiter.reserve(step.bytes); delay != step.delay {
+				t.Errorf("%s: step %d: got delay %v, want %v", test.name, i, delay, step.delay)
+			}
+		}
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter, clock := newTestRateLimiter(1000)
+	if delay := limiter.reserve(1500); delay != 500*time.Millisecond {
+		t.Fatalf("got delay %v, want 500ms", delay)
+	}
+
+	// the debt of the previous rate is dropped
+	limiter.SetRate(2000)
+	if rate := limiter.Rate(); rate != 2000 {
+		t.Errorf("got rate %v, want 2000", rate)
+	}
+	if delay := limiter.reserve(1000); delay != 500*time.Millisecond {
+		t.Errorf("raised rate: got delay %v, want 500ms", delay)
+	}
+
+	// lowering the rate empties the bucket down to the new rate
+	clock.now = clock.now.Add(time.Hour)
+	limiter.SetRate(100)
+	if delay := limiter.reserve(200); delay != time.Second {
+		t.Errorf("lowered rate: got delay %v, want 1s", delay)
+	}
+
+	limiter.SetRate(0)
+	if delay := limiter.reserve(1 << 30); delay != 0 {
+		t.Errorf("unlimited: got delay %v, want 0", delay)
+	}
+}
+
+// readAll reads the reader in small chunks, so that the limiters apply.
+func readAll(t *testing.T, reader io.Reader) {
+	buf := make([]byte, 1000)
+	for {
+		if _, err := reader.Read(buf); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	// a second worth of data is read right away, the rest at the rate
+	tests := []struct {
+		name     string
+		transfer float64
+		global   float64
+		readers  int
+		size     int
+		duration time.Duration
+	}{
+		{"transfer limit", 40000, 0, 1, 50000, 250 * time.Millisecond},
+		{"transfer limit under global", 40000, 1e9, 1, 50000, 250 * time.Millisecond},
+		{"global limit under transfer", 1e9, 40000, 1, 50000, 250 * time.Millisecond},
+		{"global limit shared", 40000, 40000, 2, 30000, 500 * time.Millisecond},
+		{"unlimited", 0, 0, 2, 1 << 20, 0},
+	}
+
+	for _, test := range tests {
+		global := NewRateLimiter(test.global)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < test.readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reader := newRateLimitedReader(context.Background(), bytes.NewReader(make([]byte, test.size)),
+					NewRateLimiter(test.transfer), global, nil)
+				readAll(t, reader)
+			}()
+		}
+		wg.Wait()
+
+		elapsed := time.Since(start)
+		if elapsed < test.duration-50*time.Millisecond || elapsed > test.duration+time.Second {
+			t.Errorf("%s: took %v, want about %v", test.name, elapsed, test.duration)
+		}
+	}
+
+	// a cancelled transfer stops waiting
+	ctx, cancel := context.WithCancelCause(context.Background())
+	reader := newRateLimitedReader(ctx, bytes.NewReader(make([]byte, 2000)), NewRateLimiter(1000))
+	cancel(ErrTransferCancelled)
+	buf := make([]byte, 2000)
+	if _, err := reader.Read(buf); err != ErrTransferCancelled {
+		t.Errorf("cancelled: got %v, want %v", err, ErrTransferCancelled)
+	}
+}
@@ -0,0 +1,106 @@
+package xdcc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures how failed connections and interrupted
+// downloads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of tries, including the first one.
+	// Each try to connect goes through TLSModes in order.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, it is multiplied
+	// by Multiplier after each retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes the delay by up to this fraction, e.g. 0.2 for ±20%.
+	Jitter float64
+	// TLSModes are tried in order on each try to connect. The modes the TLS
+	// policy forbids are skipped, see TLSPolicy.CheckModes. Empty means the
+	// default of the TLS policy.
+	TLSModes []TLSMode
+	// Retryable tells whether a failure is worth retrying.
+	// Defaults to IsRetryable.
+	Retryable func(err error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Backoff returns the delay before the given retry, starting at 1.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	if p.InitialBackoff <= 0 || retry < 1 {
+		return 0
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// IsRetryable reports whether err is a transient failure: network errors,
+// timeouts and IRC errors are retried, certificate, file, parse, bot and
+// authentication errors are not. Cancelled transfers are never retried.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrTransferCancelled) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	switch errorTypeOf(err) {
+	case ErrorTypeNetwork, ErrorTypeTimeout, ErrorTypeIRC:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepContext waits for d, it returns false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
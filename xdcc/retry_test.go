@@ -0,0 +1,132 @@
+package xdcc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}
+	tests := []struct {
+		policy   RetryPolicy
+		retry    int
+		expected time.Duration
+	}{
+		{policy, 0, 0},
+		{policy, 1, time.Second},
+		{policy, 2, 2 * time.Second},
+		{policy, 3, 4 * time.Second},
+		{policy, 4, 8 * time.Second},
+		{policy, 5, 10 * time.Second},
+		{policy, 50, 10 * time.Second},
+		{RetryPolicy{InitialBackoff: time.Second}, 5, time.Second},
+		{RetryPolicy{InitialBackoff: time.Second, Multiplier: 0.5}, 5, time.Second},
+		{RetryPolicy{InitialBackoff: time.Second, Multiplier: 3}, 4, 27 * time.Second},
+		{RetryPolicy{MaxBackoff: time.Minute, Multiplier: 2}, 3, 0},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.Backoff(test.retry); got != test.expected {
+			t.Errorf("%+v.Backoff(%d) = %s, want %s", test.policy, test.retry, got, test.expected)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2, Jitter: 0.2}
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{3, 3200 * time.Millisecond, 4800 * time.Millisecond},
+		// jitter applies to the capped delay
+		{10, 8 * time.Second, 12 * time.Second},
+	}
+
+	for _, test := range tests {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 1000; i++ {
+			got := policy.Backoff(test.retry)
+			if got < test.min || got > test.max {
+				t.Fatalf("Backoff(%d) = %s, want within [%s, %s]", test.retry, got, test.min, test.max)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Backoff(%d) is not randomized", test.retry)
+		}
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	tests := []struct {
+		maxAttempts int
+		expected    int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{5, 5},
+	}
+
+	for _, test := range tests {
+		if got := (RetryPolicy{MaxAttempts: test.maxAttempts}).maxAttempts(); got != test.expected {
+			t.Errorf("maxAttempts() with MaxAttempts %d = %d, want %d", test.maxAttempts, got, test.expected)
+		}
+	}
+
+	// the last attempt fails the transfer instead of restarting it
+	transfer := newXdccTransfer(Config{Retry: RetryPolicy{MaxAttempts: 1}})
+	transfer.restart("interrupted", newTransferError(ErrorTypeNetwork, errors.New("connection reset")))
+	for {
+		select {
+		case e := <-transfer.PollEvents():
+			switch e.(type) {
+			case *TransferRetryEvent:
+				t.Fatal("transfer retried past MaxAttempts")
+			case *TransferAbortedEvent:
+				return
+			}
+		default:
+			t.Fatal("transfer was not aborted")
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{newTransferError(ErrorTypeNetwork, errors.New("connection reset")), true},
+		{newTransferError(ErrorTypeTimeout, &PhaseTimeoutError{Phase: PhaseJoin}), true},
+		{newTransferError(ErrorTypeIRC, errors.New("closing link")), true},
+		{fmt.Errorf("connect: %w", newTransferError(ErrorTypeNetwork, errors.New("refused"))), true},
+		{newTransferError(ErrorTypeSSL, errors.New("unknown authority")), false},
+		{newTransferError(ErrorTypeFile, errors.New("permission denied")), false},
+		{newTransferError(ErrorTypeParse, errors.New("invalid port")), false},
+		{newTransferError(ErrorTypeBot, &BotRejectionError{Reason: BotRejectInvalidPack}), false},
+		{newTransferError(ErrorTypeAuth, &AuthError{Method: AuthSASLPlain}), false},
+		{newTransferError(ErrorTypeChecksum, &ChecksumMismatchError{}), false},
+		{newTransferError(ErrorTypeOffer, &OfferRejectedError{}), false},
+		{errors.New("unknown"), false},
+		{newTransferError(ErrorTypeNetwork, ErrTransferCancelled), false},
+		{newTransferError(ErrorTypeNetwork, context.Canceled), false},
+	}
+
+	for _, test := range tests {
+		if got := IsRetryable(test.err); got != test.expected {
+			t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.expected)
+		}
+	}
+
+	policy := RetryPolicy{Retryable: func(err error) bool { return errorTypeOf(err) == ErrorTypeSSL }}
+	if !policy.retryable(newTransferError(ErrorTypeSSL, errors.New("handshake"))) ||
+		policy.retryable(newTransferError(ErrorTypeNetwork, errors.New("reset"))) {
+		t.Error("RetryPolicy.Retryable is not used")
+	}
+}
@@ -0,0 +1,179 @@
+package xdcc
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Limits bounds the number of active transfers. A transfer is active from
+// the moment its pack is requested until it ends. Zero means unlimited.
+type Limits struct {
+	Global     int
+	PerNetwork int
+	PerBot     int
+}
+
+// DefaultLimits allows a single transfer per bot, which is what most bots
+// grant to a user.
+var DefaultLimits = Limits{PerBot: 1}
+
+// Limit names, reported by TransferWaitingEvent.
+const (
+	LimitGlobal  = "global"
+	LimitNetwork = "network"
+	LimitBot     = "bot"
+)
+
+// Scheduler holds pack requests back until the limits allow them. Waiting
+// requests are granted in the order they were made. It is safe for
+// concurrent use by the transfers sharing it.
+type Scheduler struct {
+	mu         sync.Mutex
+	limits     Limits
+	active     int
+	perNetwork map[string]int
+	perBot     map[string]int
+	waiting    []*schedulerTicket
+}
+
+type schedulerTicket struct {
+	network string
+	bot     string
+	granted chan struct{}
+}
+
+func NewScheduler(limits Limits) *Scheduler {
+	return &Scheduler{
+		limits:     limits,
+		perNetwork: map[string]int{},
+		perBot:     map[string]int{},
+	}
+}
+
+// Limits returns the current limits.
+func (s *Scheduler) Limits() Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits
+}
+
+// SetLimits changes the limits, waiting transfers are started if the new
+// limits allow it. Running transfers are never stopped.
+func (s *Scheduler) SetLimits(limits Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = limits
+	s.grantLocked()
+}
+
+func schedulerKeys(file IRCFile) (string, string) {
+	network := strings.ToLower(file.Network)
+	return network, network + "/" + strings.ToLower(file.UserName)
+}
+
+// acquire waits until a transfer of the given file may start. onWait is
+// called with the limit holding it back if it cannot start right away.
+// The returned function gives the slot back.
+func (s *Scheduler) acquire(ctx context.Context, file IRCFile, onWait func(limit string)) (func(), error) {
+	network, bot := schedulerKeys(file)
+	ticket := &schedulerTicket{network: network, bot: bot, granted: make(chan struct{})}
+
+	s.mu.Lock()
+	limit := s.blockingLimitLocked(network, bot)
+	if limit == "" && len(s.waiting) == 0 {
+		s.takeLocked(ticket)
+		s.mu.Unlock()
+		return s.releaseFunc(ticket), nil
+	}
+	s.waiting = append(s.waiting, ticket)
+	s.grantLocked()
+	limit = s.blockingLimitLocked(network, bot)
+	s.mu.Unlock()
+
+	select {
+	case <-ticket.granted:
+		return s.releaseFunc(ticket), nil
+	default:
+	}
+	onWait(limit)
+
+	select {
+	case <-ticket.granted:
+		return s.releaseFunc(ticket), nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ticket.granted:
+		// granted while giving up
+		s.releaseLocked(ticket)
+	default:
+		s.removeLocked(ticket)
+	}
+	return nil, context.Cause(ctx)
+}
+
+// blockingLimitLocked returns the limit a new transfer would exceed, if any.
+func (s *Scheduler) blockingLimitLocked(network string, bot string) string {
+	switch {
+	case s.limits.Global > 0 && s.active >= s.limits.Global:
+		return LimitGlobal
+	case s.limits.PerNetwork > 0 && s.perNetwork[network] >= s.limits.PerNetwork:
+		return LimitNetwork
+	case s.limits.PerBot > 0 && s.perBot[bot] >= s.limits.PerBot:
+		return LimitBot
+	}
+	return ""
+}
+
+// grantLocked starts the waiting transfers the limits allow, oldest first.
+// A transfer held back by its bot does not block those of other bots.
+func (s *Scheduler) grantLocked() {
+	waiting := s.waiting[:0]
+	for _, ticket := range s.waiting {
+		if s.blockingLimitLocked(ticket.network, ticket.bot) != "" {
+			waiting = append(waiting, ticket)
+			continue
+		}
+		s.takeLocked(ticket)
+		close(ticket.granted)
+	}
+	s.waiting = waiting
+}
+
+func (s *Scheduler) takeLocked(ticket *schedulerTicket) {
+	s.active++
+	s.perNetwork[ticket.network]++
+	s.perBot[ticket.bot]++
+}
+
+func (s *Scheduler) releaseFunc(ticket *schedulerTicket) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.releaseLocked(ticket)
+		})
+	}
+}
+
+func (s *Scheduler) releaseLocked(ticket *schedulerTicket) {
+	s.active--
+	s.perNetwork[ticket.network]--
+	s.perBot[ticket.bot]--
+	s.grantLocked()
+}
+
+func (s *Scheduler) removeLocked(ticket *schedulerTicket) {
+	for i, t := range s.waiting {
+		if t == ticket {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package xdcc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// pendingAcquire is a call to acquire running in the background.
+type pendingAcquire struct {
+	// limit is the limit that held it back, if any
+	limit   string
+	release chan func()
+}
+
+// acquireAsync calls acquire for the file and returns once it either got a
+// slot or is held back.
+func acquireAsync(t *testing.T, s *Scheduler, file IRCFile) *pendingAcquire {
+	waiting := make(chan string, 1)
+	a := &pendingAcquire{release: make(chan func(), 1)}
+	go func() {
+		release, err := s.acquire(context.Background(), file, func(limit string) { waiting <- limit })
+		if err == nil {
+			a.release <- release
+		}
+	}()
+
+	select {
+	case a.limit = <-waiting:
+	case release := <-a.release:
+		a.release <- release
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire neither started nor waited")
+	}
+	return a
+}
+
+// granted returns the release function once the slot is granted, or nil
+// if it is not within wait.
+func (a *pendingAcquire) granted(wait time.Duration) func() {
+	select {
+	case release := <-a.release:
+		return release
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func botFile(network string, bot string) IRCFile {
+	return IRCFile{Network: network, UserName: bot}
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		active []IRCFile
+		file   IRCFile
+		limit  string
+	}{
+		{"no limits", Limits{}, []IRCFile{botFile("a", "bot"), botFile("a", "bot")}, botFile("a", "bot"), ""},
+		{"per bot", Limits{PerBot: 1}, []IRCFile{botFile("a", "bot")}, botFile("a", "BOT"), LimitBot},
+		{"per bot other bot", Limits{PerBot: 1}, []IRCFile{botFile("a", "bot")}, botFile("a", "other"), ""},
+		{"per bot other network", Limits{PerBot: 1}, []IRCFile{botFile("a", "bot")}, botFile("b", "bot"), ""},
+		{"per network", Limits{PerNetwork: 2}, []IRCFile{botFile("a", "bot"), botFile("A", "other")}, botFile("a", "third"), LimitNetwork},
+		{"per network other network", Limits{PerNetwork: 2}, []IRCFile{botFile("a", "bot"), botFile("a", "other")}, botFile("b", "bot"), ""},
+		{"global", Limits{Global: 2}, []IRCFile{botFile("a", "bot"), botFile("b", "bot")}, botFile("c", "bot"), LimitGlobal},
+		{"global below", Limits{Global: 3}, []IRCFile{botFile("a", "bot"), botFile("b", "bot")}, botFile("c", "bot"), ""},
+	}
+
+	for _, test := range tests {
+		s := NewScheduler(test.limits)
+		var releases []func()
+		for _, active := range test.active {
+			release, err := s.acquire(context.Background(), active, func(limit string) {
+				t.Errorf("%s: active transfer held back by %s", test.name, limit)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			releases = append(releases, release)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		limit := ""
+		release, err := s.acquire(ctx, test.file, func(l string) {
+			limit = l
+			cancel()
+		})
+		if limit != test.limit {
+			t.Errorf("%s: held back by %q, want %q", test.name, limit, test.limit)
+		}
+		if (err == nil) != (test.limit == "") {
+			t.Errorf("%s: got error %v, want granted %v", test.name, err, test.limit == "")
+		}
+		cancel()
+
+		// the slots are given back, also by a transfer that gave up waiting
+		if release != nil {
+			releases = append(releases, release)
+		}
+		for _, release := range releases {
+			release()
+			release()
+		}
+		if s.active != 0 || len(s.waiting) != 0 {
+			t.Errorf("%s: %d active and %d waiting after release", test.name, s.active, len(s.waiting))
+		}
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := NewScheduler(Limits{PerBot: 1})
+	first := acquireAsync(t, s, botFile("a", "bot"))
+	second := acquireAsync(t, s, botFile("a", "bot"))
+	third := acquireAsync(t, s, botFile("a", "bot"))
+	if first.limit != "" || second.limit != LimitBot || third.limit != LimitBot {
+		t.Fatalf("got limits %q, %q, %q, want only the first granted", first.limit, second.limit, third.limit)
+	}
+
+	// a transfer of another bot is not held back by those waiting
+	if other := acquireAsync(t, s, botFile("a", "other")); other.limit != "" {
+		t.Errorf("other bot held back by %q", other.limit)
+	}
+
+	// waiting transfers are granted in the order they asked
+	first.granted(time.Second)()
+	release := second.granted(time.Second)
+	if release == nil {
+		t.Fatal("second transfer not granted after the first ended")
+	}
+	if third.granted(50*time.Millisecond) != nil {
+		t.Fatal("third transfer granted before the second ended")
+	}
+	release()
+	if third.granted(time.Second) == nil {
+		t.Fatal("third transfer not granted after the second ended")
+	}
+}
+
+func TestSchedulerSetLimits(t *testing.T) {
+	s := NewScheduler(Limits{Global: 1})
+	first := acquireAsync(t, s, botFile("a", "bot"))
+	second := acquireAsync(t, s, botFile("b", "bot"))
+	third := acquireAsync(t, s, botFile("c", "bot"))
+	if second.limit != LimitGlobal || third.limit != LimitGlobal {
+		t.Fatalf("got limits %q, %q, want global", second.limit, third.limit)
+	}
+
+	s.SetLimits(Limits{Global: 2})
+	if s.Limits().Global != 2 {
+		t.Errorf("got limits %+v, want global 2", s.Limits())
+	}
+	if second.granted(time.Second) == nil {
+		t.Error("waiting transfer not granted by the raised limit")
+	}
+	if third.granted(50*time.Millisecond) != nil {
+		t.Error("transfer granted beyond the raised limit")
+	}
+
+	// lowering the limits does not stop running transfers
+	s.SetLimits(Limits{Global: 1})
+	first.granted(time.Second)()
+	if third.granted(50*time.Millisecond) != nil {
+		t.Error("transfer granted beyond the lowered limit")
+	}
+	s.SetLimits(Limits{})
+	if third.granted(time.Second) == nil {
+		t.Error("waiting transfer not granted once the limit was removed")
+	}
+}
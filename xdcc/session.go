@@ -0,0 +1,657 @@
+package xdcc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xdcc-cli/proxy"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// SessionPool shares IRC connections between transfers: transfers on the
+// same network, through the same proxy and with the same TLS settings
+// send their pack requests over a single registered connection.
+type SessionPool struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*session
+}
+
+func NewSessionPool() *SessionPool {
+	return &SessionPool{sessions: map[sessionKey]*session{}}
+}
+
+type sessionKey struct {
+	network  string
+	port     int
+	proxyURL string
+	security TLSSecurity
+	sslOnly  bool
+	method   AuthMethod
+	account  string
+	identity Identity
+}
+
+var errSessionClosed = errors.New("session closed")
+
+type sessionState int
+
+const (
+	sessionIdle sessionState = iota
+	sessionConnecting
+	// sessionConnected means the socket is open but the server has
+	// not welcomed us yet
+	sessionConnected
+	// sessionRegistered means we are waiting for NickServ or SASL to
+	// identify us
+	sessionRegistered
+	// sessionReady means channels can be joined
+	sessionReady
+)
+
+// connectAttempt is the outcome of connecting a session, shared by all
+// transfers waiting for it.
+type connectAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// session is a connection to an IRC network used by one or more transfers.
+// Its connection, TLS and retry settings are those of the transfer that
+// opened it.
+type session struct {
+	pool *SessionPool
+	key  sessionKey
+	conn *irc.Conn
+
+	network     string
+	port        int
+	tlsPolicy   TLSPolicy
+	tlsModes    []TLSMode
+	tlsMode     TLSMode
+	retryPolicy RetryPolicy
+	auth        Credentials
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu              sync.Mutex
+	transfers       []*XdccTransfer
+	state           sessionState
+	attempt         *connectAttempt
+	connAttempts    int
+	joined          map[string]bool
+	joining         map[string]bool
+	requestSeq      int
+	security        SecurityLevel
+	certFingerprint string
+	authState       authState
+	authErr         error
+}
+
+func newSession(pool *SessionPool, key sessionKey, transfer *XdccTransfer) *session {
+	rand.Seed(time.Now().UTC().UnixNano())
+	identity := key.identity
+
+	config := irc.NewConfig(identity.nick(), identity.Ident, identity.RealName)
+	config.NewNick = identity.newNick
+	// the library answers CTCP VERSION and PING itself
+	config.Version = identity.Version
+	// Set proxy if configured
+	config.Proxy = key.proxyURL
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s := &session{
+		pool:        pool,
+		key:         key,
+		conn:        irc.Client(config),
+		network:     key.network,
+		port:        key.port,
+		tlsPolicy:   transfer.tlsPolicy,
+		tlsModes:    transfer.tlsModes,
+		retryPolicy: transfer.retryPolicy,
+		auth:        transfer.auth,
+		ctx:         ctx,
+		cancel:      cancel,
+		joined:      map[string]bool{},
+		joining:     map[string]bool{},
+	}
+	s.setupHandlers()
+	s.setupAuthHandlers()
+	return s
+}
+
+// attach adds the transfer to the session for its network, opening one
+// if needed. It returns the session, its state and, while it is
+// connecting, the connection attempt to wait for.
+func (pool *SessionPool) attach(transfer *XdccTransfer) (*session, sessionState, *connectAttempt) {
+	key := sessionKey{
+		network:  strings.ToLower(transfer.url.Network),
+		port:     transfer.url.Port,
+		proxyURL: proxy.ProxyURL(),
+		security: transfer.tlsPolicy.security(),
+		sslOnly:  transfer.sslOnly,
+		method:   transfer.auth.Method,
+		account:  transfer.auth.Account,
+		identity: transfer.identity,
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	s, ok := pool.sessions[key]
+	if !ok {
+		s = newSession(pool, key, transfer)
+		pool.sessions[key] = s
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transfers = append(s.transfers, transfer)
+	if s.state == sessionIdle {
+		s.state = sessionConnecting
+		s.attempt = &connectAttempt{done: make(chan struct{})}
+		go func() {
+			s.connectDone(s.connect())
+		}()
+	}
+	return s, s.state, s.attempt
+}
+
+// detach removes the transfer from the session, the connection is closed
+// once no transfer uses it anymore.
+func (s *session) detach(transfer *XdccTransfer) {
+	s.pool.mu.Lock()
+	s.mu.Lock()
+	for i, t := range s.transfers {
+		if t == transfer {
+			s.transfers = append(s.transfers[:i], s.transfers[i+1:]...)
+			break
+		}
+	}
+	empty := len(s.transfers) == 0
+	if empty && s.pool.sessions[s.key] == s {
+		delete(s.pool.sessions, s.key)
+	}
+	s.mu.Unlock()
+	s.pool.mu.Unlock()
+
+	if empty {
+		s.close()
+	}
+}
+
+func (s *session) close() {
+	s.cancel(errSessionClosed)
+	// handlers run on the connection loop, which Close waits for
+	go func() {
+		if s.conn.Connected() {
+			s.conn.Quit()
+			s.conn.Close()
+		}
+	}()
+}
+
+// each calls fn for every transfer of the session.
+func (s *session) each(fn func(transfer *XdccTransfer)) {
+	s.mu.Lock()
+	transfers := append([]*XdccTransfer(nil), s.transfers...)
+	s.mu.Unlock()
+
+	for _, transfer := range transfers {
+		fn(transfer)
+	}
+}
+
+// connect opens the connection. Each attempt tries the TLS modes of the
+// TLS policy in order; failed attempts are retried with backoff as long
+// as the error is retryable.
+func (s *session) connect() error {
+	policy := s.retryPolicy
+	var err error
+	for attempt := 1; ; attempt++ {
+		for _, mode := range s.tlsModes {
+			s.setTLSMode(mode)
+			s.each(func(transfer *XdccTransfer) {
+				transfer.emitConnectingEvent(mode != TLSModePlain)
+			})
+			if err = s.conn.ConnectContext(s.ctx); err == nil {
+				return nil
+			}
+			if s.ctx.Err() != nil {
+				return context.Cause(s.ctx)
+			}
+			err = classifyConnectError(err)
+		}
+
+		if attempt >= policy.maxAttempts() || !policy.retryable(err) {
+			return err
+		}
+
+		delay := policy.Backoff(attempt)
+		s.each(func(transfer *XdccTransfer) {
+			transfer.notifyEvent(&TransferRetryEvent{
+				URL:         transfer.url.String(),
+				Attempt:     attempt + 1,
+				MaxAttempts: policy.maxAttempts(),
+				Reason:      "connect failed",
+				Delay:       delay,
+			})
+		})
+		if !sleepContext(s.ctx, delay) {
+			return context.Cause(s.ctx)
+		}
+	}
+}
+
+// connectDone records the outcome of the current connection attempt
+// and wakes up the transfers waiting for it.
+func (s *session) connectDone(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.state = sessionIdle
+	} else if s.state == sessionConnecting {
+		s.state = sessionConnected
+	}
+	s.attempt.err = err
+	close(s.attempt.done)
+}
+
+// setTLSMode configures how the next connection to the server is secured.
+func (s *session) setTLSMode(mode TLSMode) {
+	config := s.conn.Config()
+	// irc.Conn would append the port to a bare IPv6 address without
+	// brackets
+	host, port := splitNetwork(s.network)
+	if s.port != 0 {
+		port = s.port
+	}
+	if port == 0 {
+		port = defaultPort(mode)
+	}
+	config.Server = net.JoinHostPort(host, strconv.Itoa(port))
+	// the dialer of SASL sessions does the handshake, see saslDialer
+	config.SSL = mode != TLSModePlain && !s.usesSASL()
+	config.SSLConfig = s.tlsPolicy.tlsConfig(host, mode, s.setSecurity)
+	if s.auth.Certificate != nil {
+		config.SSLConfig.Certificates = []tls.Certificate{*s.auth.Certificate}
+	}
+	s.tlsMode = mode
+	if mode == TLSModePlain {
+		s.setSecurity(SecurityPlaintext, "")
+	}
+}
+
+// splitNetwork returns the host of a network and its port, zero when it
+// has none. Networks from search results may carry their port.
+func splitNetwork(network string) (string, int) {
+	host, portStr, err := net.SplitHostPort(network)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(network, "["), "]"), 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// defaultPort is the port of networks whose URL gives none.
+func defaultPort(mode TLSMode) int {
+	if mode == TLSModePlain {
+		return 6667
+	}
+	return 6697
+}
+
+func (s *session) securityInfo() (SecurityLevel, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.security, s.certFingerprint
+}
+
+// setSecurity records how the server connection was secured.
+func (s *session) setSecurity(level SecurityLevel, fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.security = level
+	s.certFingerprint = fingerprint
+}
+
+func (s *session) privmsg(target string, req CTCPRequest) {
+	s.conn.Privmsg(target, req.String())
+}
+
+func (s *session) sendDCC(target string, req CTCPRequest) {
+	s.conn.Ctcp(target, DCC, req.String())
+}
+
+// join makes the transfer request its pack once its channel is joined
+// and the scheduler allows it.
+func (s *session) join(transfer *XdccTransfer) {
+	channel := strings.ToLower(transfer.url.Channel)
+
+	s.mu.Lock()
+	joined, joining := s.joined[channel], s.joining[channel]
+	if !joined && !joining {
+		s.joining[channel] = true
+	}
+	s.mu.Unlock()
+
+	switch {
+	case joined:
+		transfer.schedulePack()
+	case !joining && transfer.url.Key != "":
+		s.conn.Join(transfer.url.Channel, transfer.url.Key)
+	case !joining:
+		s.conn.Join(transfer.url.Channel)
+	}
+}
+
+// nextRequest numbers pack requests, so that offers are matched to the
+// oldest pending request of the bot.
+func (s *session) nextRequest(transfer *XdccTransfer) {
+	s.mu.Lock()
+	s.requestSeq++
+	seq := s.requestSeq
+	s.mu.Unlock()
+
+	transfer.mu.Lock()
+	transfer.requestSeq = seq
+	transfer.mu.Unlock()
+}
+
+func (s *session) setupHandlers() {
+	conn := s.conn
+
+	conn.HandleFunc(irc.CONNECTED,
+		func(conn *irc.Conn, line *irc.Line) {
+			s.mu.Lock()
+			s.state = sessionRegistered
+			s.connAttempts = 0
+			s.joined = map[string]bool{}
+			s.joining = map[string]bool{}
+			security, fingerprint := s.security, s.certFingerprint
+			s.mu.Unlock()
+
+			s.each(func(transfer *XdccTransfer) {
+				transfer.notifyConnected(security, fingerprint)
+			})
+			if !s.registered() {
+				return
+			}
+
+			s.mu.Lock()
+			s.state = sessionReady
+			s.mu.Unlock()
+			s.each(func(transfer *XdccTransfer) {
+				transfer.joinChannel()
+			})
+		})
+
+	conn.HandleFunc(irc.ERROR, func(conn *irc.Conn, line *irc.Line) {
+		s.each(func(transfer *XdccTransfer) {
+			transfer.notifyEvent(&TransferErrorEvent{
+				URL:       transfer.url.String(),
+				Error:     line.Text(),
+				ErrorType: string(ErrorTypeIRC),
+				Fatal:     false,
+			})
+		})
+	})
+
+	// send xdcc send on successfull join
+	conn.HandleFunc(irc.JOIN,
+		func(conn *irc.Conn, line *irc.Line) {
+			if line.Nick != conn.Me().Nick {
+				return
+			}
+			channel := strings.ToLower(line.Args[0])
+
+			s.mu.Lock()
+			s.joined[channel] = true
+			delete(s.joining, channel)
+			s.mu.Unlock()
+
+			s.each(func(transfer *XdccTransfer) {
+				if strings.EqualFold(transfer.url.Channel, channel) && !transfer.isStarted() &&
+					transfer.currentPhase() == PhaseJoin {
+					transfer.schedulePack()
+				}
+			})
+		})
+
+	// ERR_CHANNELISFULL, ERR_INVITEONLYCHAN, ERR_BANNEDFROMCHAN,
+	// ERR_BADCHANNELKEY, ERR_NEEDREGGEDNICK
+	for _, numeric := range []string{"471", "473", "474", "475", "477"} {
+		conn.HandleFunc(numeric, s.handleJoinRefused)
+	}
+
+	conn.HandleFunc(irc.PRIVMSG, s.handleBotMessage)
+	conn.HandleFunc(irc.NOTICE, s.handleBotMessage)
+
+	conn.HandleFunc(irc.CTCP,
+		func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) < 2 {
+				return
+			}
+			if reply, ok := ctcpReply(line.Args[0]); ok {
+				conn.CtcpReply(line.Nick, line.Args[0], reply)
+				return
+			}
+			// offers sent to a channel are not for us
+			if line.Args[0] != DCC || line.Public() {
+				return
+			}
+			s.handleDCC(line.Nick, line.Text())
+		})
+
+	conn.HandleFunc(irc.DISCONNECTED, s.handleDisconnected)
+}
+
+// JoinError is reported when the server does not let the client into the
+// channel of a transfer.
+type JoinError struct {
+	Channel string
+	Message string
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("cannot join %s: %s", e.Channel, e.Message)
+}
+
+// handleJoinRefused fails the transfers joining a channel the server
+// refused, rather than letting them run into the join timeout.
+func (s *session) handleJoinRefused(conn *irc.Conn, line *irc.Line) {
+	if len(line.Args) < 2 {
+		return
+	}
+	channel := strings.ToLower(line.Args[1])
+
+	s.mu.Lock()
+	delete(s.joining, channel)
+	s.mu.Unlock()
+
+	err := newTransferError(ErrorTypeChannel, &JoinError{Channel: line.Args[1], Message: line.Text()})
+	s.each(func(transfer *XdccTransfer) {
+		if strings.EqualFold(transfer.url.Channel, channel) && transfer.currentPhase() == PhaseJoin {
+			transfer.fail(err)
+		}
+	})
+}
+
+// handleDCC passes a DCC message of the bot to the transfer it is for.
+func (s *session) handleDCC(bot string, text string) {
+	res, err := parseCTCPRes(text)
+	if err != nil {
+		for _, transfer := range s.pendingTransfers(bot) {
+			transfer.notifyError(newTransferError(ErrorTypeParse, err))
+		}
+		return
+	}
+
+	switch r := res.(type) {
+	case *XdccSendRes:
+		if transfer := s.transferForOffer(bot, r); transfer != nil {
+			transfer.handleXdccSendRes(r)
+		}
+	case *XdccAcceptRes:
+		// only the transfer that asked to resume this offer acts on it
+		for _, transfer := range s.pendingTransfers(bot) {
+			transfer.handleXdccAcceptRes(r)
+		}
+	}
+}
+
+// pendingTransfers returns the transfers that requested their pack from
+// the bot and are not downloading it. Those the scheduler holds back have
+// not asked the bot anything yet.
+func (s *session) pendingTransfers(bot string) []*XdccTransfer {
+	var transfers []*XdccTransfer
+	s.each(func(transfer *XdccTransfer) {
+		if strings.EqualFold(transfer.url.UserName, bot) && transfer.requested() > 0 && !transfer.isStarted() {
+			transfers = append(transfers, transfer)
+		}
+	})
+	return transfers
+}
+
+// awaitingTransfers returns the pending transfers waiting for the bot to
+// answer their request or to send the pack.
+func (s *session) awaitingTransfers(bot string) []*XdccTransfer {
+	var transfers []*XdccTransfer
+	for _, transfer := range s.pendingTransfers(bot) {
+		if transfer.awaitingOffer() {
+			transfers = append(transfers, transfer)
+		}
+	}
+	return transfers
+}
+
+// oldestRequest returns the transfer of the given phase that requested its
+// pack first, if any.
+func oldestRequest(transfers []*XdccTransfer, phase Phase) *XdccTransfer {
+	var oldest *XdccTransfer
+	for _, transfer := range transfers {
+		if transfer.currentPhase() != phase {
+			continue
+		}
+		if oldest == nil || transfer.requested() < oldest.requested() {
+			oldest = transfer
+		}
+	}
+	return oldest
+}
+
+// transferForOffer picks the transfer a DCC SEND from the bot belongs to:
+// the one that was downloading the same file before a restart, else the
+// oldest request still waiting for an offer.
+func (s *session) transferForOffer(bot string, send *XdccSendRes) *XdccTransfer {
+	var match *XdccTransfer
+	for _, transfer := range s.awaitingTransfers(bot) {
+		if transfer.lastOfferedName() == send.FileName {
+			return transfer
+		}
+		if match == nil || transfer.requested() < match.requested() {
+			match = transfer
+		}
+	}
+	return match
+}
+
+// handleBotMessage passes a private reply of the bot to the transfer of
+// the pack it is about. Bots answer requests in order, so a reply that
+// does not tell its pack is for the oldest request not answered yet.
+func (s *session) handleBotMessage(conn *irc.Conn, line *irc.Line) {
+	// announcements of the bot in the channel are not replies
+	if len(line.Args) < 2 || line.Public() {
+		return
+	}
+	transfers := s.awaitingTransfers(line.Nick)
+	if len(transfers) == 0 {
+		return
+	}
+
+	text := line.Text()
+	var transfer *XdccTransfer
+	if slot, ok := botMessagePack(text); ok {
+		for _, t := range transfers {
+			if t.url.Slot == slot {
+				transfer = t
+				break
+			}
+		}
+	} else if len(transfers) == 1 {
+		transfer = transfers[0]
+	} else {
+		transfer = oldestRequest(transfers, PhaseOffer)
+	}
+
+	if transfer != nil {
+		transfer.handleBotMessage(text)
+	}
+}
+
+func (s *session) handleDisconnected(conn *irc.Conn, line *irc.Line) {
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.state = sessionConnecting
+	s.attempt = &connectAttempt{done: make(chan struct{})}
+	s.mu.Unlock()
+
+	policy := s.retryPolicy
+	var err error = newTransferError(ErrorTypeNetwork, errors.New("max connection attempts exceeded"))
+	for s.connAttempts+1 < policy.maxAttempts() {
+		s.connAttempts++
+		delay := policy.Backoff(s.connAttempts)
+		s.each(func(transfer *XdccTransfer) {
+			transfer.notifyEvent(&TransferRetryEvent{
+				URL:         transfer.url.String(),
+				Attempt:     s.connAttempts + 1,
+				MaxAttempts: policy.maxAttempts(),
+				Reason:      "disconnected",
+				Delay:       delay,
+			})
+		})
+		if !sleepContext(s.ctx, delay) {
+			return
+		}
+
+		s.each(func(transfer *XdccTransfer) {
+			if !transfer.isStarted() {
+				transfer.enterPhase(PhaseConnect)
+			}
+		})
+		s.setTLSMode(s.tlsMode)
+		if err = conn.ConnectContext(s.ctx); err == nil {
+			s.connectDone(nil)
+			return
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		err = classifyConnectError(err)
+		if !policy.retryable(err) {
+			break
+		}
+	}
+	s.connectDone(err)
+
+	// a running download does not need the IRC connection
+	s.each(func(transfer *XdccTransfer) {
+		if !transfer.isStarted() {
+			transfer.fail(err)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package xdcc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// newTestSession returns an unconnected session with a transfer for each
+// slot of the bot.
+func newTestSession(t *testing.T, slots ...int) (*session, []*XdccTransfer) {
+	pool := NewSessionPool()
+	var transfers []*XdccTransfer
+	for _, slot := range slots {
+		transfers = append(transfers, newXdccTransfer(Config{
+			File: IRCFile{Network: "irc.example.net", Channel: "#chan", UserName: "Bot", Slot: slot},
+			Pool: pool,
+		}))
+	}
+
+	s := newSession(pool, sessionKey{network: "irc.example.net"}, transfers[0])
+	s.transfers = transfers
+	t.Cleanup(func() { s.cancel(errSessionClosed) })
+	return s, transfers
+}
+
+// request makes the transfer ask the bot for its pack, without sending it.
+func request(s *session, transfer *XdccTransfer) {
+	s.nextRequest(transfer)
+	transfer.enterPhase(PhaseOffer)
+}
+
+func botNotice(s *session, target string, text string) {
+	s.handleBotMessage(s.conn, &irc.Line{Nick: "Bot", Cmd: irc.NOTICE, Args: []string{target, text}})
+}
+
+func TestSessionRoutesRepliesToRequests(t *testing.T) {
+	s, transfers := newTestSession(t, 1, 2)
+	requested, held := transfers[0], transfers[1]
+	request(s, requested)
+	held.enterPhase(PhaseWaiting)
+
+	botNotice(s, "me", "You have been queued, position 3 of 10")
+	if phase := requested.currentPhase(); phase != PhaseQueued {
+		t.Errorf("requested transfer is %q, want queued", phase)
+	}
+	if phase := held.currentPhase(); phase != PhaseWaiting {
+		t.Errorf("held transfer is %q, want waiting", phase)
+	}
+
+	send := &XdccSendRes{FileName: "slot1.bin", IP: net.IPv4(127, 0, 0, 1), Port: 5000, FileSize: 10}
+	if transfer := s.transferForOffer("Bot", send); transfer != requested {
+		t.Errorf("offer went to slot %v, want slot 1", transfer.url.Slot)
+	}
+
+	botNotice(s, "me", "** Invalid Pack Number, Try Again")
+	if !requested.isFinished() {
+		t.Error("rejected transfer did not fail")
+	}
+	if held.isFinished() {
+		t.Error("held transfer failed on the rejection of another pack")
+	}
+}
+
+func TestSessionIgnoresChannelLines(t *testing.T) {
+	s, transfers := newTestSession(t, 1)
+	request(s, transfers[0])
+
+	botNotice(s, "#chan", "** Invalid Pack Number, Try Again")
+	s.handleBotMessage(s.conn, &irc.Line{Nick: "Bot", Cmd: irc.PRIVMSG, Args: []string{"#chan", "queued in position 1"}})
+	if transfers[0].isFinished() || transfers[0].currentPhase() != PhaseOffer {
+		t.Errorf("channel lines changed the transfer to %q", transfers[0].currentPhase())
+	}
+
+	botNotice(s, "me", "You have been queued, position 1")
+	if phase := transfers[0].currentPhase(); phase != PhaseQueued {
+		t.Errorf("private reply left the transfer %q, want queued", phase)
+	}
+}
+
+func TestSessionRoutesRepliesInRequestOrder(t *testing.T) {
+	s, transfers := newTestSession(t, 1, 2, 3)
+	first, second, third := transfers[0], transfers[1], transfers[2]
+	request(s, first)
+	request(s, second)
+	request(s, third)
+
+	// replies without a pack go to the oldest unanswered request
+	botNotice(s, "me", "You have been queued, position 1")
+	botNotice(s, "me", "You have been queued, position 2")
+	if first.currentPhase() != PhaseQueued || second.currentPhase() != PhaseQueued || third.currentPhase() != PhaseOffer {
+		t.Errorf("got phases %q, %q, %q, want queued, queued, offer",
+			first.currentPhase(), second.currentPhase(), third.currentPhase())
+	}
+
+	// replies naming a pack go to its transfer only
+	botNotice(s, "me", "Denied, pack #2 xdcc send denied")
+	if first.isFinished() || !second.isFinished() || third.isFinished() {
+		t.Error("rejection of pack 2 did not end only its transfer")
+	}
+
+	// offers go to the oldest request, or to the transfer restarting the file
+	send := &XdccSendRes{FileName: "slot3.bin", IP: net.IPv4(127, 0, 0, 1), Port: 5000, FileSize: 10}
+	if transfer := s.transferForOffer("Bot", send); transfer != first {
+		t.Errorf("offer went to slot %d, want slot 1", transfer.url.Slot)
+	}
+	third.lastFile = lastFile{offeredName: "slot3.bin"}
+	if transfer := s.transferForOffer("Bot", send); transfer != third {
+		t.Errorf("offer went to slot %d, want slot 3", transfer.url.Slot)
+	}
+	if transfer := s.transferForOffer("OtherBot", send); transfer != nil {
+		t.Errorf("offer of another bot went to slot %d", transfer.url.Slot)
+	}
+}
+
+func TestSessionIgnoresOffersWithoutRequest(t *testing.T) {
+	s, transfers := newTestSession(t, 1)
+	transfers[0].enterPhase(PhaseJoin)
+
+	send := &XdccSendRes{FileName: "file.bin", IP: net.IPv4(127, 0, 0, 1), Port: 5000, FileSize: 10}
+	if transfer := s.transferForOffer("Bot", send); transfer != nil {
+		t.Error("offer went to a transfer that did not request its pack")
+	}
+	botNotice(s, "me", "** Invalid Pack Number, Try Again")
+	if transfers[0].isFinished() {
+		t.Error("rejection ended a transfer that did not request its pack")
+	}
+}
+
+func TestSessionServerAddress(t *testing.T) {
+	tests := []struct {
+		network    string
+		port       int
+		mode       TLSMode
+		expected   string
+		serverName string
+	}{
+		{"irc.example.net", 0, TLSModeVerify, "irc.example.net:6697", "irc.example.net"},
+		{"irc.example.net", 0, TLSModePlain, "irc.example.net:6667", "irc.example.net"},
+		{"irc.example.net", 7000, TLSModePlain, "irc.example.net:7000", "irc.example.net"},
+		{"::1", 0, TLSModeInsecure, "[::1]:6697", "::1"},
+		{"::1", 0, TLSModePlain, "[::1]:6667", "::1"},
+		{"2001:db8::1", 6668, TLSModeVerify, "[2001:db8::1]:6668", "2001:db8::1"},
+		{"irc.example.net:7000", 0, TLSModeVerify, "irc.example.net:7000", "irc.example.net"},
+		{"irc.example.net:7000", 6697, TLSModeVerify, "irc.example.net:6697", "irc.example.net"},
+		{"[::1]:7000", 0, TLSModePlain, "[::1]:7000", "::1"},
+		{"[::1]", 0, TLSModeVerify, "[::1]:6697", "::1"},
+	}
+
+	for _, test := range tests {
+		s := newSession(NewSessionPool(), sessionKey{network: test.network, port: test.port}, newXdccTransfer(Config{}))
+		s.setTLSMode(test.mode)
+		config := s.conn.Config()
+		if config.Server != test.expected {
+			t.Errorf("%s port %d %s: got %q, want %q", test.network, test.port, test.mode, config.Server, test.expected)
+		}
+		// the certificate is checked and pinned for the host alone
+		if config.SSLConfig.ServerName != test.serverName {
+			t.Errorf("%s port %d %s: got server name %q, want %q", test.network, test.port, test.mode, config.SSLConfig.ServerName, test.serverName)
+		}
+	}
+}
+
+func TestSessionJoinRefused(t *testing.T) {
+	port, _ := fakeIRCServer(t, map[string][]string{
+		"USER":           {":irc.test 001 $nick :Welcome"},
+		"JOIN #chan bad": {":irc.test 475 $nick #chan :Cannot join channel (+k) - bad key"},
+	})
+	transfer := newXdccTransfer(Config{
+		File:     IRCFile{Network: "127.0.0.1", Port: port, Channel: "#chan", Key: "bad", UserName: "Bot", Slot: 1},
+		TLS:      TLSPolicy{Security: TLSPlaintextAllowed},
+		Retry:    RetryPolicy{MaxAttempts: 1, TLSModes: []TLSMode{TLSModePlain}},
+		Timeouts: Timeouts{Join: time.Minute},
+	})
+	t.Cleanup(func() { transfer.Cancel(context.Background()) })
+	if err := transfer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-transfer.PollEvents():
+			if e, ok := e.(*TransferErrorEvent); ok {
+				expected := "cannot join #chan: Cannot join channel (+k) - bad key"
+				if e.ErrorType != string(ErrorTypeChannel) || e.Error != expected || !e.Fatal {
+					t.Errorf("got %s error %q, want fatal channel error %q", e.ErrorType, e.Error, expected)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("transfer did not fail")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package xdcc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SizePolicy bounds the size of the files accepted from bots.
+type SizePolicy struct {
+	// MaxSize rejects the offers of larger files. Zero means no limit.
+	MaxSize int64
+	// Expected is the size advertised for the pack, by a search result for
+	// instance. Zero means unknown.
+	Expected int64
+	// MaxDeviation is the largest accepted difference between the offered
+	// and the Expected size, as a fraction of Expected (0.1 for 10%).
+	// Zero disables the check.
+	MaxDeviation float64
+	// Preallocate reserves the disk space of the file before downloading,
+	// where the filesystem supports it.
+	Preallocate bool
+}
+
+// OfferRejectionReason tells why an offer of the bot was refused.
+type OfferRejectionReason string
+
+const (
+	OfferTooLarge     OfferRejectionReason = "too-large"
+	OfferSizeMismatch OfferRejectionReason = "size-mismatch"
+	OfferNoSpace      OfferRejectionReason = "no-space"
+)
+
+// OfferRejectedError is reported when the offered file is not downloaded
+// because of its size. Limit is the maximum size, the expected size or the
+// free space, depending on the reason.
+type OfferRejectedError struct {
+	Reason   OfferRejectionReason
+	FileSize int64
+	Limit    int64
+}
+
+func (e *OfferRejectedError) Error() string {
+	switch e.Reason {
+	case OfferTooLarge:
+		return fmt.Sprintf("offered file of %d bytes is larger than the maximum of %d bytes", e.FileSize, e.Limit)
+	case OfferSizeMismatch:
+		return fmt.Sprintf("offered file of %d bytes differs from the advertised size of %d bytes", e.FileSize, e.Limit)
+	}
+	if e.Limit > 0 {
+		return fmt.Sprintf("not enough free space for %d bytes, %d bytes available", e.FileSize, e.Limit)
+	}
+	return fmt.Sprintf("not enough free space for %d bytes", e.FileSize)
+}
+
+// check returns an OfferRejectedError if a file of the given size must
+// not be downloaded. Zero is an unknown size, only MaxSize applies to it,
+// once the downloaded data exceeds it.
+func (p SizePolicy) check(size int64) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return &OfferRejectedError{Reason: OfferTooLarge, FileSize: size, Limit: p.MaxSize}
+	}
+	if size > 0 && p.Expected > 0 && p.MaxDeviation > 0 &&
+		math.Abs(float64(size-p.Expected)) > p.MaxDeviation*float64(p.Expected) {
+		return &OfferRejectedError{Reason: OfferSizeMismatch, FileSize: size, Limit: p.Expected}
+	}
+	return nil
+}
+
+var errFreeSpaceUnsupported = errors.New("free space unknown on this platform")
+
+// checkFreeSpace returns an OfferRejectedError if the filesystem of dir
+// cannot hold needed more bytes. It is skipped when the free space is
+// unknown.
+func checkFreeSpace(dir string, needed int64) error {
+	available, err := freeSpace(dir)
+	if err != nil || needed <= 0 {
+		return nil
+	}
+	if uint64(needed) > available {
+		return &OfferRejectedError{Reason: OfferNoSpace, FileSize: needed, Limit: int64(min(available, math.MaxInt64))}
+	}
+	return nil
+}
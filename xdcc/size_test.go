@@ -0,0 +1,100 @@
+package xdcc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSizePolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SizePolicy
+		size   int64
+		reason OfferRejectionReason
+		limit  int64
+	}{
+		{"no limits", SizePolicy{}, 1 << 40, "", 0},
+		{"below maximum", SizePolicy{MaxSize: 1000}, 1000, "", 0},
+		{"too large", SizePolicy{MaxSize: 1000}, 1001, OfferTooLarge, 1000},
+		{"unknown size", SizePolicy{MaxSize: 1000, Expected: 500, MaxDeviation: 0.1}, 0, "", 0},
+		{"within deviation", SizePolicy{Expected: 1000, MaxDeviation: 0.1}, 1100, "", 0},
+		{"smaller than expected", SizePolicy{Expected: 1000, MaxDeviation: 0.1}, 899, OfferSizeMismatch, 1000},
+		{"larger than expected", SizePolicy{Expected: 1000, MaxDeviation: 0.1}, 1101, OfferSizeMismatch, 1000},
+		{"expected size unknown", SizePolicy{MaxDeviation: 0.1}, 1101, "", 0},
+		{"deviation disabled", SizePolicy{Expected: 1000}, 5000, "", 0},
+		{"too large first", SizePolicy{MaxSize: 2000, Expected: 1000, MaxDeviation: 0.1}, 3000, OfferTooLarge, 2000},
+	}
+
+	for _, test := range tests {
+		err := test.policy.check(test.size)
+		var rejected *OfferRejectedError
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want the offer accepted", test.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &rejected) || rejected.Reason != test.reason ||
+			rejected.FileSize != test.size || rejected.Limit != test.limit {
+			t.Errorf("%s: got %v, want %s rejection of %d bytes with limit %d", test.name, err, test.reason, test.size, test.limit)
+		}
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	available, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("free space unknown: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		needed   int64
+		rejected bool
+	}{
+		{"fits", dir, 1, false},
+		{"unknown size", dir, 0, false},
+		{"no space", dir, int64(available) + 1<<40, true},
+		{"free space unknown", filepath.Join(dir, "missing"), int64(available) + 1<<40, false},
+	}
+
+	for _, test := range tests {
+		err := checkFreeSpace(test.dir, test.needed)
+		var rejected *OfferRejectedError
+		if !test.rejected {
+			if err != nil {
+				t.Errorf("%s: got %v, want no error", test.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &rejected) || rejected.Reason != OfferNoSpace ||
+			rejected.FileSize != test.needed || rejected.Limit <= 0 {
+			t.Errorf("%s: got %v, want a no-space rejection of %d bytes", test.name, err, test.needed)
+		}
+	}
+}
+
+func TestPreallocateKeepsSize(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "file.bin.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString("partial")
+
+	if err := preallocate(file, 1<<20); err != nil {
+		t.Skipf("preallocation unsupported: %v", err)
+	}
+	// the size of a part file tells how much to resume
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("partial")) {
+		t.Errorf("got size %d, want %d", info.Size(), len("partial"))
+	}
+}
@@ -0,0 +1,68 @@
+package xdcc
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// StallPolicy configures how a stuck DCC data stream is detected.
+// A stalled transfer is restarted, resuming from what was received.
+type StallPolicy struct {
+	// Timeout is the longest time without receiving any byte, or
+	// blocked sending an acknowledgement. Zero disables the check.
+	Timeout time.Duration
+	// MinSpeed is the lowest acceptable average speed in bytes/s,
+	// measured over MinSpeedPeriod. Zero disables the check.
+	MinSpeed       float64
+	MinSpeedPeriod time.Duration
+}
+
+var DefaultStallPolicy = StallPolicy{
+	Timeout:        2 * time.Minute,
+	MinSpeedPeriod: 30 * time.Second,
+}
+
+var (
+	ErrTransferStalled = errors.New("transfer stalled")
+	ErrTransferTooSlow = errors.New("transfer below minimum speed")
+)
+
+// stallDetector tracks the average speed of the current measurement window.
+type stallDetector struct {
+	policy      StallPolicy
+	windowStart time.Time
+	windowBytes int
+}
+
+func newStallDetector(policy StallPolicy) *stallDetector {
+	return &stallDetector{
+		policy:      policy,
+		windowStart: time.Now(),
+	}
+}
+
+// update accounts for n received bytes and reports whether the speed
+// over the last full window was below the minimum.
+func (d *stallDetector) update(n int) bool {
+	if d.policy.MinSpeed <= 0 || d.policy.MinSpeedPeriod <= 0 {
+		return false
+	}
+
+	d.windowBytes += n
+	elapsed := time.Since(d.windowStart)
+	if elapsed < d.policy.MinSpeedPeriod {
+		return false
+	}
+
+	tooSlow := float64(d.windowBytes)/elapsed.Seconds() < d.policy.MinSpeed
+	d.windowStart = time.Now()
+	d.windowBytes = 0
+	return tooSlow
+}
+
+// isTimeout reports whether err is a read or write deadline expiring.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
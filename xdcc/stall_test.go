@@ -0,0 +1,106 @@
+package xdcc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStallDetectorUpdate(t *testing.T) {
+	period := time.Minute
+	tests := []struct {
+		name    string
+		policy  StallPolicy
+		elapsed time.Duration
+		bytes   int
+		tooSlow bool
+		reset   bool
+	}{
+		{"disabled", StallPolicy{MinSpeedPeriod: period}, 2 * period, 0, false, false},
+		{"no period", StallPolicy{MinSpeed: 1000}, time.Hour, 0, false, false},
+		{"window not over", StallPolicy{MinSpeed: 1000, MinSpeedPeriod: period}, period / 2, 0, false, false},
+		{"too slow", StallPolicy{MinSpeed: 1000, MinSpeedPeriod: period}, period, 1000, true, true},
+		{"just fast enough", StallPolicy{MinSpeed: 1000, MinSpeedPeriod: period}, period, 61000, false, true},
+		{"fast", StallPolicy{MinSpeed: 1000, MinSpeedPeriod: period}, 2 * period, 1 << 30, false, true},
+	}
+
+	for _, test := range tests {
+		d := newStallDetector(test.policy)
+		d.windowStart = time.Now().Add(-test.elapsed)
+		if tooSlow := d.update(test.bytes); tooSlow != test.tooSlow {
+			t.Errorf("%s: got too slow %v, want %v", test.name, tooSlow, test.tooSlow)
+		}
+		// a new window starts once one is measured
+		reset := d.windowBytes == 0 && time.Since(d.windowStart) < time.Second
+		if test.bytes > 0 && reset != test.reset {
+			t.Errorf("%s: got window reset %v, want %v", test.name, reset, test.reset)
+		}
+	}
+
+	// the bytes of a window add up until it is over
+	d := newStallDetector(StallPolicy{MinSpeed: 1000, MinSpeedPeriod: period})
+	d.update(31000)
+	d.windowStart = time.Now().Add(-period)
+	if d.update(31000) {
+		t.Error("window of 62000 bytes in a minute is too slow")
+	}
+}
+
+// stalledDownload starts downloading from a bot that sends the first half
+// of the file and then nothing.
+func stalledDownload(t *testing.T, retry RetryPolicy) (*XdccTransfer, string) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	send := &XdccSendRes{FileName: "file.bin", IP: net.IPv4(127, 0, 0, 1), FileSize: len(data)}
+	send.Port = fakeBot(t, data[:50], len(data))
+
+	dir := t.TempDir()
+	transfer := newXdccTransfer(Config{
+		OutPath: dir,
+		Stall:   StallPolicy{Timeout: 100 * time.Millisecond},
+		Retry:   retry,
+	})
+	t.Cleanup(func() { transfer.Cancel(context.Background()) })
+	filePath := filepath.Join(dir, send.FileName)
+	transfer.download(send, filePath, 0)
+	return transfer, filePath
+}
+
+func TestStallRestart(t *testing.T) {
+	// the pack is requested again after the backoff, resuming the part file
+	transfer, filePath := stalledDownload(t, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour})
+	timeout := time.After(5 * time.Second)
+	for retry := (*TransferRetryEvent)(nil); retry == nil; {
+		select {
+		case e := <-transfer.PollEvents():
+			switch e := e.(type) {
+			case *TransferRetryEvent:
+				retry = e
+				if e.Reason != "stalled" || e.Attempt != 2 {
+					t.Errorf("got retry %+v, want attempt 2 for a stall", e)
+				}
+			case *TransferAbortedEvent:
+				t.Fatalf("transfer aborted: %s", e.Error)
+			}
+		case <-timeout:
+			t.Fatal("stalled download was not restarted")
+		}
+	}
+	if transfer.isStarted() {
+		t.Error("restarting transfer still marked as downloading")
+	}
+	if part, err := os.ReadFile(PartFilePath(filePath)); err != nil || len(part) != 50 {
+		t.Errorf("got part file of %d bytes, %v, want the 50 received", len(part), err)
+	}
+
+	// without attempts left the stall fails the transfer
+	transfer, _ = stalledDownload(t, RetryPolicy{MaxAttempts: 1})
+	e := waitError(transfer, 5*time.Second)
+	if e == nil || !errors.Is(e.Err, ErrTransferStalled) || e.ErrorType != string(ErrorTypeNetwork) {
+		t.Errorf("got %+v, want a stalled network error", e)
+	}
+}
@@ -0,0 +1,133 @@
+package xdcc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Phase is a stage of a transfer before the file data starts flowing.
+type Phase string
+
+const (
+	PhaseConnect Phase = "connect"
+	PhaseJoin    Phase = "join"
+	PhaseOffer   Phase = "offer"
+	PhaseQueued  Phase = "queued"
+	// PhaseWaiting is spent waiting for the scheduler, it has no timeout.
+	PhaseWaiting Phase = "waiting"
+)
+
+// Timeouts bounds how long a transfer may stay in each phase.
+// A zero duration disables the corresponding timeout.
+type Timeouts struct {
+	// Connect is the time allowed to connect and register to the network.
+	Connect time.Duration
+	// Join is the time allowed to join the channel once connected.
+	Join time.Duration
+	// Offer is the time allowed for the bot to answer the pack request.
+	Offer time.Duration
+	// Queued is the time allowed to wait in the bot queue.
+	Queued time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Connect: time.Minute,
+	Join:    time.Minute,
+	Offer:   3 * time.Minute,
+	Queued:  0,
+}
+
+func (t Timeouts) forPhase(phase Phase) time.Duration {
+	switch phase {
+	case PhaseConnect:
+		return t.Connect
+	case PhaseJoin:
+		return t.Join
+	case PhaseOffer:
+		return t.Offer
+	case PhaseQueued:
+		return t.Queued
+	}
+	return 0
+}
+
+// PhaseTimeoutError is reported when a phase runs past its limit.
+type PhaseTimeoutError struct {
+	Phase   Phase
+	Timeout time.Duration
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	switch e.Phase {
+	case PhaseConnect:
+		return fmt.Sprintf("timed out connecting to network after %s", e.Timeout)
+	case PhaseJoin:
+		return fmt.Sprintf("timed out joining channel after %s", e.Timeout)
+	case PhaseOffer:
+		return fmt.Sprintf("timed out waiting for the bot to send the file after %s", e.Timeout)
+	case PhaseQueued:
+		return fmt.Sprintf("timed out waiting in the bot queue after %s", e.Timeout)
+	}
+	return fmt.Sprintf("timed out in phase %s after %s", e.Phase, e.Timeout)
+}
+
+// enterPhase arms the timeout of the given phase, replacing the one of the
+// previous phase.
+func (transfer *XdccTransfer) enterPhase(phase Phase) {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+
+	transfer.stopPhaseTimerLocked()
+	transfer.phase = phase
+
+	timeout := transfer.timeouts.forPhase(phase)
+	if timeout <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	transfer.phaseTimer = timer
+	go func() {
+		select {
+		case <-timer.C:
+		case <-transfer.ctx.Done():
+			return
+		}
+
+		transfer.mu.Lock()
+		current := transfer.phaseTimer == timer
+		transfer.mu.Unlock()
+
+		if current {
+			transfer.fail(newTransferError(ErrorTypeTimeout, &PhaseTimeoutError{Phase: phase, Timeout: timeout}))
+		}
+	}()
+}
+
+// enterQueuedPhase switches to the queued phase, keeping the running
+// timeout when the bot merely updates our position.
+func (transfer *XdccTransfer) enterQueuedPhase() {
+	transfer.mu.Lock()
+	queued := transfer.phase == PhaseQueued
+	transfer.mu.Unlock()
+
+	if !queued {
+		transfer.enterPhase(PhaseQueued)
+	}
+}
+
+// leavePhases disarms the phase timeout, once file data is flowing.
+func (transfer *XdccTransfer) leavePhases() {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+
+	transfer.stopPhaseTimerLocked()
+	transfer.phase = ""
+}
+
+func (transfer *XdccTransfer) stopPhaseTimerLocked() {
+	if transfer.phaseTimer != nil {
+		transfer.phaseTimer.Stop()
+		transfer.phaseTimer = nil
+	}
+}
@@ -0,0 +1,100 @@
+package xdcc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitError returns the error the transfer failed with, nil if it did not
+// fail within wait.
+func waitError(transfer *XdccTransfer, wait time.Duration) *TransferErrorEvent {
+	timeout := time.After(wait)
+	for {
+		select {
+		case e := <-transfer.PollEvents():
+			if e, ok := e.(*TransferErrorEvent); ok {
+				return e
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func TestPhaseTimeout(t *testing.T) {
+	timeouts := Timeouts{
+		Connect: 20 * time.Millisecond,
+		Join:    20 * time.Millisecond,
+		Offer:   20 * time.Millisecond,
+		Queued:  20 * time.Millisecond,
+	}
+	tests := []struct {
+		phase   Phase
+		message string
+	}{
+		{PhaseConnect, "timed out connecting to network after 20ms"},
+		{PhaseJoin, "timed out joining channel after 20ms"},
+		{PhaseOffer, "timed out waiting for the bot to send the file after 20ms"},
+		{PhaseQueued, "timed out waiting in the bot queue after 20ms"},
+	}
+
+	for _, test := range tests {
+		transfer := newXdccTransfer(Config{Timeouts: timeouts})
+		transfer.enterPhase(test.phase)
+
+		e := waitError(transfer, 5*time.Second)
+		if e == nil {
+			t.Errorf("%s: phase did not expire", test.phase)
+			continue
+		}
+		var timeoutErr *PhaseTimeoutError
+		if !errors.As(e.Err, &timeoutErr) || timeoutErr.Phase != test.phase || timeoutErr.Timeout != 20*time.Millisecond {
+			t.Errorf("%s: got %v, want a timeout of the phase", test.phase, e.Err)
+		}
+		if e.Error != test.message || e.ErrorType != string(ErrorTypeTimeout) || !e.Fatal {
+			t.Errorf("%s: got %s error %q, want fatal timeout %q", test.phase, e.ErrorType, e.Error, test.message)
+		}
+		if !transfer.isFinished() {
+			t.Errorf("%s: transfer not finished after its timeout", test.phase)
+		}
+	}
+}
+
+func TestPhaseTimeoutDisarmed(t *testing.T) {
+	timeouts := Timeouts{Join: 30 * time.Millisecond, Offer: 0, Queued: 30 * time.Millisecond}
+	tests := []struct {
+		name  string
+		enter func(transfer *XdccTransfer)
+	}{
+		{"phase without timeout", func(transfer *XdccTransfer) {
+			transfer.enterPhase(PhaseOffer)
+		}},
+		{"waiting for the scheduler", func(transfer *XdccTransfer) {
+			transfer.enterPhase(PhaseWaiting)
+		}},
+		{"replaced by the next phase", func(transfer *XdccTransfer) {
+			transfer.enterPhase(PhaseJoin)
+			transfer.enterPhase(PhaseOffer)
+		}},
+		{"left for the download", func(transfer *XdccTransfer) {
+			transfer.enterPhase(PhaseQueued)
+			transfer.leavePhases()
+		}},
+	}
+
+	for _, test := range tests {
+		transfer := newXdccTransfer(Config{Timeouts: timeouts})
+		test.enter(transfer)
+		if e := waitError(transfer, 150*time.Millisecond); e != nil {
+			t.Errorf("%s: got %q", test.name, e.Error)
+		}
+	}
+
+	// another phase name gets the generic message
+	err := &PhaseTimeoutError{Phase: "other", Timeout: time.Second}
+	if !strings.Contains(err.Error(), "phase other after 1s") {
+		t.Errorf("got %q, want the phase named", err.Error())
+	}
+}
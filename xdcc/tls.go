@@ -0,0 +1,394 @@
+package xdcc
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSMode is the way a single connection to the IRC server is secured.
+type TLSMode string
+
+const (
+	// TLSModeVerify uses TLS, the certificate is checked by the TLS policy.
+	TLSModeVerify TLSMode = "tls"
+	// TLSModeInsecure uses TLS and accepts a certificate failing the check
+	// of the TLS policy as SecurityUnverified. It needs TLSPlaintextAllowed.
+	TLSModeInsecure TLSMode = "tls-insecure"
+	// TLSModePlain uses an unencrypted connection. It needs TLSPlaintextAllowed.
+	TLSModePlain TLSMode = "plain"
+)
+
+var ErrInvalidTLSMode = errors.New("invalid TLS mode")
+
+// ParseTLSModes parses a comma separated list of TLS modes, e.g. "tls,plain".
+func ParseTLSModes(s string) ([]TLSMode, error) {
+	var modes []TLSMode
+	for _, field := range strings.Split(s, ",") {
+		mode := TLSMode(strings.TrimSpace(field))
+		switch mode {
+		case TLSModeVerify, TLSModeInsecure, TLSModePlain:
+			modes = append(modes, mode)
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTLSMode, field)
+		}
+	}
+	return modes, nil
+}
+
+// TLSSecurity selects which server certificates are accepted and whether
+// an unencrypted connection may be used when TLS fails.
+type TLSSecurity string
+
+const (
+	// TLSStrict only accepts certificates signed by a trusted authority.
+	TLSStrict TLSSecurity = "strict"
+	// TLSAllowUnknownAuthority also accepts self-signed certificates and
+	// certificates of unknown authorities, as long as the hostname matches.
+	TLSAllowUnknownAuthority TLSSecurity = "allow-unknown-authority"
+	// TLSTrustOnFirstUse accepts an unverifiable certificate the first time
+	// a network is seen and pins it; later connections must present the
+	// same certificate.
+	TLSTrustOnFirstUse TLSSecurity = "tofu"
+	// TLSPlaintextAllowed falls back to an unencrypted connection when a
+	// verified TLS connection cannot be established.
+	TLSPlaintextAllowed TLSSecurity = "plaintext-allowed"
+)
+
+var ErrInvalidTLSSecurity = errors.New("invalid TLS policy")
+
+func ParseTLSSecurity(s string) (TLSSecurity, error) {
+	switch security := TLSSecurity(s); security {
+	case "":
+		return TLSStrict, nil
+	case TLSStrict, TLSAllowUnknownAuthority, TLSTrustOnFirstUse, TLSPlaintextAllowed:
+		return security, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidTLSSecurity, s)
+}
+
+// SecurityLevel is the protection actually negotiated with the server,
+// it is reported by TransferConnectedEvent.
+type SecurityLevel string
+
+const (
+	// SecurityVerified is TLS with a certificate signed by a trusted authority.
+	SecurityVerified SecurityLevel = "verified"
+	// SecurityUnknownAuthority is TLS with a certificate of an unknown authority.
+	SecurityUnknownAuthority SecurityLevel = "unknown-authority"
+	// SecurityPinned is TLS with the certificate pinned on a previous connection.
+	SecurityPinned SecurityLevel = "pinned"
+	// SecurityFirstUse is TLS with a certificate seen for the first time,
+	// it is pinned from now on.
+	SecurityFirstUse SecurityLevel = "first-use"
+	// SecurityUnverified is TLS with a certificate that could not be
+	// verified. It is only accepted with TLSPlaintextAllowed, by
+	// TLSModeInsecure and for DCC, or from a bot without a certificate
+	// connecting back for a passive SSEND offer.
+	SecurityUnverified SecurityLevel = "unverified"
+	// SecurityPlaintext is an unencrypted connection.
+	SecurityPlaintext SecurityLevel = "plaintext"
+)
+
+// TLSPolicy configures how connections to IRC servers are secured.
+type TLSPolicy struct {
+	// Security defaults to TLSStrict.
+	Security TLSSecurity
+	// RootCAs are the authorities trusted to sign server certificates.
+	// Nil means the system pool, see LoadCABundle.
+	RootCAs *x509.CertPool
+	// KnownHosts stores the pinned certificates of TLSTrustOnFirstUse.
+	KnownHosts *KnownHosts
+}
+
+func (p TLSPolicy) security() TLSSecurity {
+	if p.Security == "" {
+		return TLSStrict
+	}
+	return p.Security
+}
+
+// CheckModes reports an error if the policy forbids one of the modes:
+// only TLSPlaintextAllowed lets a connection go unverified.
+func (p TLSPolicy) CheckModes(modes []TLSMode) error {
+	for _, mode := range modes {
+		if !p.allows(mode) {
+			return fmt.Errorf("%w: %s needs the %s policy", ErrInvalidTLSMode, mode, TLSPlaintextAllowed)
+		}
+	}
+	return nil
+}
+
+func (p TLSPolicy) allows(mode TLSMode) bool {
+	return mode == TLSModeVerify || p.security() == TLSPlaintextAllowed
+}
+
+// modes returns the connection modes to try in order: the requested ones
+// the policy allows, by default TLS and, with TLSPlaintextAllowed, plain.
+func (p TLSPolicy) modes(requested []TLSMode) []TLSMode {
+	var modes []TLSMode
+	for _, mode := range requested {
+		if p.allows(mode) {
+			modes = append(modes, mode)
+		}
+	}
+	switch {
+	case len(modes) > 0:
+		return modes
+	case p.security() == TLSPlaintextAllowed:
+		return []TLSMode{TLSModeVerify, TLSModePlain}
+	}
+	return []TLSMode{TLSModeVerify}
+}
+
+// tlsConfig returns the configuration used to connect to host. The
+// certificate is checked by the policy itself, onVerified is called with
+// the security level it was accepted with. TLSModeInsecure accepts a
+// certificate failing the check.
+func (p TLSPolicy) tlsConfig(host string, mode TLSMode, onVerified func(SecurityLevel, string)) *tls.Config {
+	return &tls.Config{
+		ServerName: host,
+		// verification is done below, depending on the policy
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			level, err := p.verify(host, host, cs.PeerCertificates)
+			if err != nil && mode == TLSModeInsecure && len(cs.PeerCertificates) > 0 {
+				level, err = SecurityUnverified, nil
+			}
+			if err != nil {
+				return err
+			}
+			onVerified(level, certFingerprint(cs.PeerCertificates[0]))
+			return nil
+		},
+	}
+}
+
+// verify checks the certificate chain of host. pin is the name its
+// certificate is pinned under with TLSTrustOnFirstUse.
+func (p TLSPolicy) verify(host string, pin string, certs []*x509.Certificate) (SecurityLevel, error) {
+	if len(certs) == 0 {
+		return "", &tls.CertificateVerificationError{Err: errors.New("peer did not present a certificate")}
+	}
+	leaf := certs[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         p.RootCAs,
+		Intermediates: intermediates,
+	})
+	if err == nil {
+		return SecurityVerified, nil
+	}
+
+	var unknownAuth x509.UnknownAuthorityError
+	switch p.security() {
+	case TLSAllowUnknownAuthority:
+		if errors.As(err, &unknownAuth) {
+			if err := leaf.VerifyHostname(host); err != nil {
+				return "", &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: err}
+			}
+			return SecurityUnknownAuthority, nil
+		}
+	case TLSTrustOnFirstUse:
+		if p.KnownHosts != nil {
+			return p.KnownHosts.check(pin, leaf)
+		}
+	}
+	return "", &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: err}
+}
+
+// dccTLSConfig returns the configuration of the TLS connection of a SSEND
+// offer. The bot certificate is checked like the one of the IRC server
+// and pinned under pin. Since such an offer cannot fall back to plaintext,
+// TLSPlaintextAllowed accepts a certificate that fails the check instead.
+// A bot connecting back for a passive offer is asked for a certificate but
+// most have none: it is then only identified by the token of the offer and
+// the connection is SecurityUnverified.
+func (p TLSPolicy) dccTLSConfig(host string, pin string, passive bool, onVerified func(SecurityLevel, string)) *tls.Config {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if passive && len(cs.PeerCertificates) == 0 {
+				onVerified(SecurityUnverified, "")
+				return nil
+			}
+			level, err := p.verify(host, pin, cs.PeerCertificates)
+			if err != nil && p.security() == TLSPlaintextAllowed {
+				level, err = SecurityUnverified, nil
+			}
+			if err != nil {
+				return err
+			}
+			fingerprint := ""
+			if len(cs.PeerCertificates) > 0 {
+				fingerprint = certFingerprint(cs.PeerCertificates[0])
+			}
+			onVerified(level, fingerprint)
+			return nil
+		},
+	}
+	if passive {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config
+}
+
+// dccCertificate is the self-signed certificate presented to the bots
+// connecting back for passive SSEND offers, it lives as long as the
+// process.
+var dccCertificate = sync.OnceValues(func() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: IRCClientUserName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+})
+
+// LoadCABundle returns the system pool extended with the PEM certificates
+// of the given file.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificatePinError is reported when a server presents a certificate
+// other than the one pinned for it.
+type CertificatePinError struct {
+	Host     string
+	Expected string
+	Got      string
+}
+
+func (e *CertificatePinError) Error() string {
+	return fmt.Sprintf("certificate of %s changed: pinned sha256 %s, got %s", e.Host, e.Expected, e.Got)
+}
+
+// KnownHosts is a file of pinned certificate fingerprints, one
+// "host sha256" pair per line. It is safe for concurrent use.
+type KnownHosts struct {
+	path string
+
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// DefaultKnownHostsPath returns the known hosts file in the user
+// configuration directory.
+func DefaultKnownHostsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "known_hosts"
+	}
+	return filepath.Join(dir, "xdcc-cli", "known_hosts")
+}
+
+// LoadKnownHosts reads the given file, a missing file has no pins.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	known := &KnownHosts{path: path, hashes: map[string]string{}}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		known.hashes[strings.ToLower(fields[0])] = strings.ToLower(fields[1])
+	}
+	return known, scanner.Err()
+}
+
+func (known *KnownHosts) check(host string, cert *x509.Certificate) (SecurityLevel, error) {
+	known.mu.Lock()
+	defer known.mu.Unlock()
+
+	host = strings.ToLower(host)
+	fingerprint := certFingerprint(cert)
+
+	pinned, ok := known.hashes[host]
+	if !ok {
+		if err := known.appendLocked(host, fingerprint); err != nil {
+			return "", err
+		}
+		return SecurityFirstUse, nil
+	}
+	if pinned != fingerprint {
+		return "", &CertificatePinError{Host: host, Expected: pinned, Got: fingerprint}
+	}
+	return SecurityPinned, nil
+}
+
+func (known *KnownHosts) appendLocked(host string, fingerprint string) error {
+	if err := os.MkdirAll(filepath.Dir(known.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(known.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "%s %s\n", host, fingerprint); err != nil {
+		return err
+	}
+	known.hashes[host] = fingerprint
+	return nil
+}
@@ -0,0 +1,144 @@
+package xdcc
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseTLSModes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []TLSMode
+		wantErr  bool
+	}{
+		{input: "tls", expected: []TLSMode{TLSModeVerify}},
+		{input: "tls, tls-insecure,plain", expected: []TLSMode{TLSModeVerify, TLSModeInsecure, TLSModePlain}},
+		{input: "plain,tls", expected: []TLSMode{TLSModePlain, TLSModeVerify}},
+		{input: "tls,ssl", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		modes, err := ParseTLSModes(test.input)
+		if test.wantErr {
+			if !errors.Is(err, ErrInvalidTLSMode) {
+				t.Errorf("%q: got %v, %v, want ErrInvalidTLSMode", test.input, modes, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(modes, test.expected) {
+			t.Errorf("%q: got %v, %v, want %v", test.input, modes, err, test.expected)
+		}
+	}
+}
+
+func TestTLSPolicyModes(t *testing.T) {
+	all := []TLSMode{TLSModePlain, TLSModeInsecure, TLSModeVerify}
+	tests := []struct {
+		security  TLSSecurity
+		requested []TLSMode
+		expected  []TLSMode
+		allowed   bool
+	}{
+		{TLSStrict, nil, []TLSMode{TLSModeVerify}, true},
+		{TLSStrict, []TLSMode{TLSModeVerify}, []TLSMode{TLSModeVerify}, true},
+		{TLSStrict, all, []TLSMode{TLSModeVerify}, false},
+		{TLSTrustOnFirstUse, []TLSMode{TLSModeInsecure}, []TLSMode{TLSModeVerify}, false},
+		{TLSAllowUnknownAuthority, []TLSMode{TLSModePlain}, []TLSMode{TLSModeVerify}, false},
+		{TLSPlaintextAllowed, nil, []TLSMode{TLSModeVerify, TLSModePlain}, true},
+		{TLSPlaintextAllowed, all, all, true},
+		{TLSPlaintextAllowed, []TLSMode{TLSModeVerify, TLSModeInsecure}, []TLSMode{TLSModeVerify, TLSModeInsecure}, true},
+	}
+
+	for _, test := range tests {
+		policy := TLSPolicy{Security: test.security}
+		if got := policy.modes(test.requested); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: modes(%v) = %v, want %v", test.security, test.requested, got, test.expected)
+		}
+		if err := policy.CheckModes(test.requested); (err == nil) != test.allowed {
+			t.Errorf("%s: CheckModes(%v) = %v, want allowed %v", test.security, test.requested, err, test.allowed)
+		}
+	}
+
+	// ircs URLs and SSLOnly drop the plaintext mode
+	transfer := newXdccTransfer(Config{
+		File:  IRCFile{SSL: true},
+		TLS:   TLSPolicy{Security: TLSPlaintextAllowed},
+		Retry: RetryPolicy{TLSModes: all},
+	})
+	if expected := []TLSMode{TLSModeInsecure, TLSModeVerify}; !reflect.DeepEqual(transfer.tlsModes, expected) {
+		t.Errorf("ssl only: got %v, want %v", transfer.tlsModes, expected)
+	}
+}
+
+// dccHandshake secures a DCC connection with a bot presenting cert, if any,
+// and returns the security level it was accepted with.
+func dccHandshake(t *testing.T, policy TLSPolicy, passive bool, cert *tls.Certificate) (SecurityLevel, error) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+
+	var level SecurityLevel
+	config := policy.dccTLSConfig("bot.example.net", "irc.example.net/Bot", passive, func(l SecurityLevel, f string) {
+		level = l
+	})
+	botConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		botConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	var ourConn, botConn *tls.Conn
+	if passive {
+		ourCert, err := dccCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{ourCert}
+		ourConn, botConn = tls.Server(ours, config), tls.Client(theirs, botConfig)
+	} else {
+		ourConn, botConn = tls.Client(ours, config), tls.Server(theirs, botConfig)
+	}
+
+	go func() {
+		botConn.Handshake()
+		theirs.Close()
+	}()
+	return level, ourConn.Handshake()
+}
+
+func TestDCCTLSConfig(t *testing.T) {
+	botCert, err := dccCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		security TLSSecurity
+		passive  bool
+		cert     *tls.Certificate
+		expected SecurityLevel
+	}{
+		{"passive without certificate", TLSStrict, true, nil, SecurityUnverified},
+		{"passive self-signed", TLSStrict, true, &botCert, ""},
+		{"passive self-signed plaintext allowed", TLSPlaintextAllowed, true, &botCert, SecurityUnverified},
+		{"active self-signed", TLSStrict, false, &botCert, ""},
+		{"active self-signed plaintext allowed", TLSPlaintextAllowed, false, &botCert, SecurityUnverified},
+	}
+
+	for _, test := range tests {
+		level, err := dccHandshake(t, TLSPolicy{Security: test.security}, test.passive, test.cert)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %q, want an error", test.name, level)
+			}
+			continue
+		}
+		if err != nil || level != test.expected {
+			t.Errorf("%s: got %q, %v, want %q", test.name, level, err, test.expected)
+		}
+	}
+}
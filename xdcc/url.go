@@ -3,67 +3,300 @@ package xdcc
 import (
 	"errors"
 	"fmt"
+	"net"
+	neturl "net/url"
 	"strconv"
 	"strings"
 )
 
 type IRCFile struct {
-	Network  string
-	Channel  string
+	Network string
+	// Port is 0 for the default port, 6697 with TLS and 6667 without.
+	Port int
+	// SSL requires a TLS connection to the network, it is set by the
+	// ircs scheme or the ssl parameter.
+	SSL     bool
+	Channel string
+	// Key is the password of the channel, if any.
+	Key      string
 	UserName string
 	Slot     int
 }
 
+// IRCPacks is a URL naming several packs of the same bot, the Slot of its
+// IRCFile is the first one.
+type IRCPacks struct {
+	IRCFile
+	Slots []int
+	// Size is the size a search result row advertised for the packs, zero
+	// when unknown.
+	Size int64
+}
+
 type IRCBot struct {
 	Network string
 	Channel string
 	Name    string
 }
 
-const ircFileURLFields = 4
+const (
+	ircFileURLFields = 4
+	// maxURLSlots bounds the number of packs of a URL, a mistyped range
+	// must not start thousands of transfers.
+	maxURLSlots = 1000
+)
+
+var ErrInvalidURL = errors.New("invalid IRC url")
+
+func invalidURL(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidURL, fmt.Sprintf(format, args...))
+}
 
 func parseSlot(slotStr string) (int, error) {
-	if strings.HasPrefix(slotStr, "#") {
-		strconv.Atoi(strings.TrimPrefix(slotStr, "#"))
+	slot, err := strconv.Atoi(strings.TrimPrefix(slotStr, "#"))
+	if err != nil || slot < 1 {
+		return 0, invalidURL("invalid slot %q", slotStr)
 	}
-	return strconv.Atoi(slotStr)
+	return slot, nil
 }
 
-var ErrInvalidURL = errors.New("invalid IRC url")
+// parseSlots parses a comma separated list of slots and slot ranges, like
+// "1-5,9". Duplicates are dropped, the order is kept.
+func parseSlots(s string) ([]int, error) {
+	var slots []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		from, err := parseSlot(first)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseSlot(last)
+		if err != nil {
+			return nil, err
+		}
+		if from > to || to-from >= maxURLSlots {
+			return nil, invalidURL("invalid slot range %q", part)
+		}
+
+		for slot := from; slot <= to; slot++ {
+			if seen[slot] {
+				continue
+			}
+			if len(slots) == maxURLSlots {
+				return nil, invalidURL("more than %d slots", maxURLSlots)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// formatSlots is the inverse of parseSlots, consecutive slots are written
+// as ranges.
+func formatSlots(slots []int) string {
+	var b strings.Builder
+	for i := 0; i < len(slots); {
+		j := i
+		for j+1 < len(slots) && slots[j+1] == slots[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(slots[i]))
+		if j > i {
+			b.WriteByte('-')
+			b.WriteString(strconv.Itoa(slots[j]))
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// parseHostPort splits the network of a URL from its optional port.
+// IPv6 addresses must be in brackets.
+func parseHostPort(s string) (string, int, error) {
+	if !strings.Contains(s, ":") {
+		if s == "" {
+			return "", 0, invalidURL("missing network")
+		}
+		return s, 0, nil
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1], 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return "", 0, invalidURL("invalid network %q", s)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, invalidURL("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
 
-// url has the following format: irc://network/channel/bot/slot
+// ParseURL parses the URL of a single pack, see ParsePacksURL.
 func ParseURL(url string) (*IRCFile, error) {
-	if !strings.HasPrefix(url, "irc://") {
+	packs, err := ParsePacksURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if len(packs.Slots) > 1 {
+		return nil, invalidURL("several slots in %q", url)
+	}
+	return &packs.IRCFile, nil
+}
+
+// ParsePacksURL parses URLs of the following format:
+//
+//	irc[s]://network[:port]/channel/bot/slots[?key=...&ssl=...]
+//
+// The ircs scheme and ssl=true require TLS, key is the channel password.
+// The channel, bot and key may be percent-escaped, the "#" of the channel
+// may be left out. Slots are a list of packs and ranges, like "1-5,9".
+func ParsePacksURL(url string) (*IRCPacks, error) {
+	packs := &IRCPacks{}
+	fileUrl := &packs.IRCFile
+
+	switch {
+	case strings.HasPrefix(url, "irc://"):
+		url = strings.TrimPrefix(url, "irc://")
+	case strings.HasPrefix(url, "ircs://"):
+		url = strings.TrimPrefix(url, "ircs://")
+		fileUrl.SSL = true
+	default:
 		return nil, ErrInvalidURL
 	}
 
-	fields := strings.Split(strings.TrimPrefix(url, "irc://"), "/")
+	url, rawQuery, _ := strings.Cut(url, "?")
+	fields := strings.Split(url, "/")
 	if len(fields) != ircFileURLFields {
 		return nil, ErrInvalidURL
 	}
+	for i, field := range fields[1:3] {
+		unescaped, err := neturl.PathUnescape(field)
+		if err != nil || unescaped == "" {
+			return nil, invalidURL("invalid path element %q", field)
+		}
+		fields[i+1] = unescaped
+	}
+
+	var err error
+	fileUrl.Network, fileUrl.Port, err = parseHostPort(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	fileUrl.Channel = fields[1]
+	fileUrl.UserName = fields[2]
 
-	slot, err := parseSlot(fields[3])
+	slots, err := parseSlots(fields[3])
 	if err != nil {
 		return nil, err
 	}
+	fileUrl.Slot = slots[0]
+	packs.Slots = slots
 
-	fileUrl := &IRCFile{
-		Network:  fields[0],
-		Channel:  fields[1],
-		UserName: fields[2],
-		Slot:     slot,
+	query, err := neturl.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, invalidURL("invalid parameters %q", rawQuery)
+	}
+	for name, values := range query {
+		value := values[len(values)-1]
+		switch name {
+		case "key":
+			fileUrl.Key = value
+		case "ssl":
+			ssl, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, invalidURL("invalid ssl parameter %q", value)
+			}
+			// only the ircs scheme sets it so far
+			if fileUrl.SSL && !ssl {
+				return nil, invalidURL("ssl=%s contradicts the ircs scheme", value)
+			}
+			fileUrl.SSL = ssl
+		default:
+			return nil, invalidURL("unknown parameter %q", name)
+		}
 	}
 
 	if !strings.HasPrefix(fileUrl.Channel, "#") {
 		fileUrl.Channel = "#" + fileUrl.Channel
 	}
-	return fileUrl, nil
+	return packs, nil
+}
+
+// Files returns the URL of each pack.
+func (packs *IRCPacks) Files() []IRCFile {
+	files := make([]IRCFile, 0, len(packs.Slots))
+	for _, slot := range packs.Slots {
+		file := packs.IRCFile
+		file.Slot = slot
+		files = append(files, file)
+	}
+	return files
+}
+
+func (packs *IRCPacks) String() string {
+	return packs.format(formatSlots(packs.Slots))
+}
+
+// Address returns the host:port of the network, empty if the port is the
+// default one.
+func (url *IRCFile) Address() string {
+	if url.Port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(url.Network, strconv.Itoa(url.Port))
 }
 
 func (url *IRCFile) GetBot() IRCBot {
 	return IRCBot{Network: url.Network, Channel: url.Channel, Name: url.UserName}
 }
 
+// escapeURLElement escapes the characters of a channel or bot name that
+// would break the URL, others like "#" and "|" are kept readable.
+func escapeURLElement(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == 0x7f || c == '/' || c == '?' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
 func (url *IRCFile) String() string {
-	return fmt.Sprintf("irc://%s/%s/%s/%d", url.Network, url.Channel, url.UserName, url.Slot)
+	return url.format(strconv.Itoa(url.Slot))
+}
+
+func (url *IRCFile) format(slots string) string {
+	scheme := "irc"
+	if url.SSL {
+		scheme = "ircs"
+	}
+
+	host := url.Address()
+	if host == "" {
+		host = url.Network
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+
+	s := fmt.Sprintf("%s://%s/%s/%s/%s", scheme, host, escapeURLElement(url.Channel), escapeURLElement(url.UserName), slots)
+	if url.Key != "" {
+		s += "?key=" + neturl.QueryEscape(url.Key)
+	}
+	return s
 }
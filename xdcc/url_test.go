@@ -0,0 +1,81 @@
+package xdcc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParsePacksURL(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  IRCPacks
+		canonical string
+	}{
+		{
+			input:     "irc://irc.rizon.net/#news/XDCC|Bot/42",
+			expected:  IRCPacks{IRCFile{Network: "irc.rizon.net", Channel: "#news", UserName: "XDCC|Bot", Slot: 42}, []int{42}, 0},
+			canonical: "irc://irc.rizon.net/#news/XDCC|Bot/42",
+		},
+		{
+			input:     "irc://irc.rizon.net/news/Bot/#7",
+			expected:  IRCPacks{IRCFile{Network: "irc.rizon.net", Channel: "#news", UserName: "Bot", Slot: 7}, []int{7}, 0},
+			canonical: "irc://irc.rizon.net/#news/Bot/7",
+		},
+		{
+			input:     "ircs://irc.rizon.net:6697/%23news/Bot/1-3,9,2",
+			expected:  IRCPacks{IRCFile{Network: "irc.rizon.net", Port: 6697, SSL: true, Channel: "#news", UserName: "Bot", Slot: 1}, []int{1, 2, 3, 9}, 0},
+			canonical: "ircs://irc.rizon.net:6697/#news/Bot/1-3,9",
+		},
+		{
+			input:     "irc://[2001:db8::1]:6667/chan/Bot/5?key=a+b%26c&ssl=1",
+			expected:  IRCPacks{IRCFile{Network: "2001:db8::1", Port: 6667, SSL: true, Channel: "#chan", UserName: "Bot", Slot: 5, Key: "a b&c"}, []int{5}, 0},
+			canonical: "ircs://[2001:db8::1]:6667/#chan/Bot/5?key=a+b%26c",
+		},
+		{
+			input:     "irc://[::1]/%23a%2Fb%20c/Bot%3F/5",
+			expected:  IRCPacks{IRCFile{Network: "::1", Channel: "#a/b c", UserName: "Bot?", Slot: 5}, []int{5}, 0},
+			canonical: "irc://[::1]/#a%2Fb%20c/Bot%3F/5",
+		},
+	}
+
+	for _, test := range tests {
+		packs, err := ParsePacksURL(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(*packs, test.expected) {
+			t.Errorf("%s: got %+v, want %+v", test.input, *packs, test.expected)
+		}
+		if got := packs.String(); got != test.canonical {
+			t.Errorf("%s: String() = %s, want %s", test.input, got, test.canonical)
+		}
+		again, err := ParsePacksURL(packs.String())
+		if err != nil || !reflect.DeepEqual(again, packs) {
+			t.Errorf("%s: round trip gave %+v, %v", test.input, again, err)
+		}
+	}
+}
+
+func TestParseURLInvalid(t *testing.T) {
+	for _, input := range []string{
+		"http://irc.rizon.net/#news/Bot/1",
+		"irc://irc.rizon.net/#news/Bot",
+		"irc://irc.rizon.net/#news/Bot/abc",
+		"irc://irc.rizon.net/#news/Bot/0",
+		"irc://irc.rizon.net/#news/Bot/5-3",
+		"irc://irc.rizon.net/#news/Bot/1-100000",
+		"irc://irc.rizon.net/#news/Bot/1-5",
+		"irc://irc.rizon.net:99999/#news/Bot/1",
+		"irc://2001:db8::1/#news/Bot/1",
+		"irc://irc.rizon.net//Bot/1",
+		"irc://irc.rizon.net/#news/Bot/1?ssl=maybe",
+		"ircs://irc.rizon.net/#news/Bot/1?ssl=false",
+		"irc://irc.rizon.net/#news/Bot/1?pass=x",
+	} {
+		if file, err := ParseURL(input); !errors.Is(err, ErrInvalidURL) {
+			t.Errorf("%s: got %+v, %v", input, file, err)
+		}
+	}
+}
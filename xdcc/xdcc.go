@@ -7,17 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"xdcc-cli/proxy"
-
-	irc "github.com/fluffle/goirc/client"
 )
 
 const IRCClientUserName = "xdcc-cli"
@@ -42,8 +39,17 @@ func (send *XdccSendReq) String() string {
 type XdccSendRes struct {
 	FileName string
 	IP       net.IP
-	Port     int
+	// Host is set instead of IP when the bot announced a hostname.
+	Host string
+	Port int
+	// FileSize is 0 when the bot did not announce the size.
 	FileSize int
+	// Token is only set for passive (reverse) offers, see IsPassive.
+	Token string
+	// Secure is set for SSEND offers, the connection is wrapped in TLS.
+	Secure bool
+	// Turbo is set for TSEND offers, the bot expects no acknowledgements.
+	Turbo bool
 }
 
 func uint32ToIP(n int) net.IP {
@@ -54,62 +60,289 @@ func uint32ToIP(n int) net.IP {
 	return net.IPv4(a, b, c, d)
 }
 
-const XdccSendResArgs = 4
+const (
+	XdccSendResMinArgs     = 3
+	XdccSendResArgs        = 4
+	XdccPassiveSendResArgs = 5
+)
 
 func (send *XdccSendRes) Name() string {
 	return SEND
 }
 
+// Parse reads the offer from its last arguments, so that unquoted file
+// names containing spaces are kept whole. The passive form, the form with a
+// size and the one without are tried in turn, as the end of a name can look
+// like an address ("my show.mkv", "Show 01"). A form is only a fallback when
+// its address looks like one a bot would send.
 func (send *XdccSendRes) Parse(args []string) error {
-	if len(args) != XdccSendResArgs {
+	n := len(args)
+	if n < XdccSendResMinArgs {
 		return errors.New("invalid number of arguments")
 	}
 
-	send.FileName = args[0]
+	type sendForm struct {
+		name                       []string
+		address, port, size, token string
+	}
+	var forms []sendForm
+	if n >= XdccPassiveSendResArgs && args[n-3] == "0" {
+		forms = append(forms, sendForm{args[:n-4], args[n-4], args[n-3], args[n-2], args[n-1]})
+	}
+	if n >= XdccSendResArgs {
+		forms = append(forms, sendForm{args[:n-3], args[n-3], args[n-2], args[n-1], ""})
+	}
+	// some bots leave the size out
+	forms = append(forms, sendForm{name: args[:n-2], address: args[n-2], port: args[n-1]})
 
-	ipUint32, err := strconv.Atoi(args[1])
+	var firstErr error
+	for i, form := range forms {
+		if i > 0 && !looksLikeDCCAddress(form.address) {
+			continue
+		}
+		err := send.parseArgs(form.name, form.address, form.port, form.size, form.token)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (send *XdccSendRes) parseArgs(name []string, address string, port string, size string, token string) error {
+	*send = XdccSendRes{Secure: send.Secure, Turbo: send.Turbo}
+
+	send.FileName = strings.Join(name, " ")
+	if send.FileName == "" {
+		return errors.New("missing file name")
+	}
+
+	var err error
+	send.IP, send.Host, err = parseDCCAddress(address)
 
 	if err != nil {
 		return err
 	}
 
-	send.IP = uint32ToIP(ipUint32)
-	send.Port, err = strconv.Atoi(args[2])
+	send.Port, err = parseDCCPort(port)
 
 	if err != nil {
 		return err
 	}
 
-	send.FileSize, err = strconv.Atoi(args[3])
+	if size != "" {
+		send.FileSize, err = strconv.Atoi(size)
+		if err != nil {
+			return err
+		}
+		if send.FileSize < 0 {
+			return errors.New("invalid file size: " + size)
+		}
+	}
+
+	send.Token = token
+	if send.Port == 0 && send.Token == "" {
+		return errors.New("invalid port: " + port)
+	}
+	return nil
+}
 
+func parseDCCPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if port < 0 || port > 65535 {
+		return 0, errors.New("invalid port: " + s)
+	}
+	return port, nil
+}
+
+// parseDCCAddress accepts the address forms found in DCC offers: a 32-bit
+// integer (classic IPv4), a dotted IPv4 or IPv6 literal, or a hostname.
+func parseDCCAddress(s string) (net.IP, string, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32ToIP(int(n)), "", nil
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, "", nil
+	}
+
+	if isHostname(s) {
+		return nil, s, nil
+	}
+	return nil, "", errors.New("invalid address: " + s)
+}
+
+// looksLikeDCCAddress tells whether s is an address a bot would send rather
+// than a word or number ending a file name: a routable IPv4 integer, an IP
+// literal or a dotted hostname.
+func looksLikeDCCAddress(s string) bool {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return n >= 1<<24
+	}
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	return isHostname(s) && strings.Contains(s, ".")
+}
+
+func isHostname(s string) bool {
+	if s == "" || len(s) > 253 || strings.HasPrefix(s, "-") || strings.HasPrefix(s, ".") {
+		return false
+	}
+
+	hasLetter := false
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			hasLetter = true
+		case r >= '0' && r <= '9', r == '-', r == '.':
+		default:
+			return false
+		}
+	}
+	// an all-numeric string is a malformed IP, not a name
+	return hasLetter
+}
+
+// Address returns the host:port the bot is listening on.
+func (send *XdccSendRes) Address() string {
+	host := send.Host
+	if host == "" {
+		host = send.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(send.Port))
+}
+
+// IsPassive reports whether the bot asked us to listen for its connection
+// instead of connecting to it (port 0 plus a token).
+func (send *XdccSendRes) IsPassive() bool {
+	return send.Port == 0 && send.Token != ""
+}
+
+// XdccPassiveSendReq is the reply to a passive offer, telling the bot
+// where to connect to.
+type XdccPassiveSendReq struct {
+	FileName string
+	IP       net.IP
+	Port     int
+	FileSize int
+	Token    string
+}
+
+func (send *XdccPassiveSendReq) String() string {
+	return fmt.Sprintf("%s %s %s %d %d %s", SEND, quoteCTCPArg(send.FileName), formatDCCAddress(send.IP), send.Port, send.FileSize, send.Token)
+}
+
+// formatDCCAddress encodes IPv4 addresses as the classic 32-bit integer
+// and IPv6 addresses as literals.
+func formatDCCAddress(ip net.IP) string {
+	if ip.To4() != nil {
+		return strconv.FormatUint(uint64(ipToUint32(ip)), 10)
+	}
+	return ip.String()
+}
+
+type XdccAcceptRes struct {
+	FileName string
+	Port     int
+	Position int
+	Token    string
+}
+
+const (
+	XdccAcceptResArgs        = 3
+	XdccPassiveAcceptResArgs = 4
+)
+
+func (accept *XdccAcceptRes) Name() string {
+	return ACCEPT
+}
+
+// Parse reads the reply from its last arguments, like XdccSendRes.Parse.
+func (accept *XdccAcceptRes) Parse(args []string) error {
+	n := len(args)
+	if n < XdccAcceptResArgs {
+		return errors.New("invalid number of arguments")
+	}
+
+	*accept = XdccAcceptRes{}
+	if n >= XdccPassiveAcceptResArgs && args[n-3] == "0" {
+		accept.Token = args[n-1]
+		args = args[:n-1]
+		n--
+	}
+
+	accept.FileName = strings.Join(args[:n-2], " ")
+
+	var err error
+	accept.Port, err = parseDCCPort(args[n-2])
+	if err != nil {
+		return err
+	}
+
+	accept.Position, err = strconv.Atoi(args[n-1])
 	if err != nil {
 		return err
 	}
+	if accept.Position < 0 {
+		return errors.New("invalid position: " + args[n-1])
+	}
 	return nil
 }
 
+type DccResumeReq struct {
+	FileName string
+	Port     int
+	Position int
+	Token    string
+}
+
+func (resume *DccResumeReq) String() string {
+	if resume.Token != "" {
+		return fmt.Sprintf("%s %s %d %d %s", RESUME, quoteCTCPArg(resume.FileName), resume.Port, resume.Position, resume.Token)
+	}
+	return fmt.Sprintf("%s %s %d %d", RESUME, quoteCTCPArg(resume.FileName), resume.Port, resume.Position)
+}
+
 const (
 	SEND    = "SEND"
-	VERSION = "\x01VERSION\x01"
+	SSEND   = "SSEND"
+	TSEND   = "TSEND"
+	ACCEPT  = "ACCEPT"
+	RESUME  = "RESUME"
+	DCC     = "DCC"
+	VERSION = "VERSION"
 )
 
+// parseCTCPRes parses the payload of a CTCP DCC message. Messages that are
+// not for a file transfer, like DCC CHAT, are ignored and return nil.
 func parseCTCPRes(text string) (CTCPResponse, error) {
-	fields := strings.Fields(text)
+	args := tokenizeCTCP(text)
+	if len(args) == 0 {
+		return nil, nil
+	}
 
-	var resp CTCPResponse = nil
+	var resp CTCPResponse
 
-	switch strings.TrimSpace(fields[0]) {
+	switch strings.ToUpper(args[0]) {
 	case SEND:
 		resp = &XdccSendRes{}
-	case VERSION:
+	case SSEND:
+		resp = &XdccSendRes{Secure: true}
+	case TSEND:
+		resp = &XdccSendRes{Turbo: true}
+	case ACCEPT:
+		resp = &XdccAcceptRes{}
+	default:
 		return nil, nil
 	}
 
-	if resp == nil {
-		return nil, errors.New("invalid command: " + fields[0])
-	}
-
-	err := resp.Parse(fields[1:])
+	err := resp.Parse(args[1:])
 	if err != nil {
 		return nil, err
 	}
@@ -118,21 +351,166 @@ func parseCTCPRes(text string) (CTCPResponse, error) {
 
 const defaultEventChanSize = 1024
 
-func (transfer *XdccTransfer) emitConnectingEvent() {
+func (transfer *XdccTransfer) emitConnectingEvent(ssl bool) {
 	transfer.notifyEvent(&TransferConnectingEvent{
 		URL:     transfer.url.String(),
 		Network: transfer.url.Network,
 		Channel: transfer.url.Channel,
 		Bot:     transfer.url.UserName,
 		Slot:    transfer.url.Slot,
-		SSL:     transfer.sslEnabled,
+		SSL:     ssl,
 	})
 }
 
+// Start connects to the IRC server, or joins the connection other transfers
+// of the pool already have to the network. It returns once the connection
+// is open or failed.
 func (transfer *XdccTransfer) Start() error {
-	transfer.emitConnectingEvent()
+	if transfer.cancelled() {
+		return context.Cause(transfer.ctx)
+	}
 	transfer.startTime = time.Now()
-	return transfer.conn.Connect()
+	transfer.enterPhase(PhaseConnect)
+
+	session, state, attempt := transfer.pool.attach(transfer)
+	transfer.mu.Lock()
+	transfer.session = session
+	transfer.mu.Unlock()
+
+	switch state {
+	case sessionReady:
+		transfer.notifyConnected(session.securityInfo())
+		transfer.joinChannel()
+		return nil
+	case sessionRegistered:
+		// the channel is joined once NickServ or SASL identified us
+		transfer.notifyConnected(session.securityInfo())
+		return nil
+	}
+
+	select {
+	case <-attempt.done:
+		if attempt.err != nil {
+			session.detach(transfer)
+		}
+		return attempt.err
+	case <-transfer.ctx.Done():
+		// report why the transfer was stopped rather than "context canceled"
+		return context.Cause(transfer.ctx)
+	}
+}
+
+var ErrTransferCancelled = errors.New("transfer cancelled")
+
+// Cancel stops the transfer: it closes the IRC connection and the DCC
+// socket and emits a TransferAbortedEvent marked as cancelled.
+// It waits for the download to stop until ctx is done.
+func (transfer *XdccTransfer) Cancel(ctx context.Context) error {
+	if transfer.finish(&TransferAbortedEvent{Error: ErrTransferCancelled.Error(), Cancelled: true}) {
+		transfer.teardown(ErrTransferCancelled)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		transfer.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finish emits the terminal event of the transfer. Only the first call
+// has an effect; it reports whether the event was emitted.
+func (transfer *XdccTransfer) finish(e TransferEvent) bool {
+	transfer.mu.Lock()
+	if transfer.finished {
+		transfer.mu.Unlock()
+		return false
+	}
+	transfer.finished = true
+	transfer.mu.Unlock()
+
+	transfer.notifyEvent(e)
+	return true
+}
+
+// teardown releases the IRC connection and the DCC socket.
+// cause is reported by Start if it is still connecting.
+func (transfer *XdccTransfer) teardown(cause error) {
+	transfer.cancel(cause)
+
+	transfer.mu.Lock()
+	if transfer.resume != nil {
+		transfer.resume.timer.Stop()
+		transfer.resume = nil
+	}
+	transfer.stopPhaseTimerLocked()
+	dataConn := transfer.dataConn
+	releaseSlot := transfer.releaseSlot
+	transfer.releaseSlot = nil
+	transfer.mu.Unlock()
+
+	if dataConn != nil {
+		dataConn.Close()
+	}
+	if releaseSlot != nil {
+		releaseSlot()
+	}
+
+	if session := transfer.getSession(); session != nil {
+		session.detach(transfer)
+	}
+}
+
+func (transfer *XdccTransfer) getSession() *session {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.session
+}
+
+func (transfer *XdccTransfer) cancelled() bool {
+	return transfer.ctx.Err() != nil
+}
+
+func (transfer *XdccTransfer) isFinished() bool {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.finished
+}
+
+// notifyError reports a non-fatal error.
+func (transfer *XdccTransfer) notifyError(err error) {
+	transfer.notifyEvent(&TransferErrorEvent{
+		URL:       transfer.url.String(),
+		Error:     err.Error(),
+		ErrorType: string(errorTypeOf(err)),
+		Fatal:     false,
+		Err:       err,
+	})
+}
+
+// fail reports a fatal error and aborts the transfer. Errors caused by
+// tearing down a cancelled or finished transfer are ignored.
+func (transfer *XdccTransfer) fail(err error) {
+	if transfer.cancelled() || transfer.isFinished() {
+		return
+	}
+
+	transfer.notifyEvent(&TransferErrorEvent{
+		URL:       transfer.url.String(),
+		Error:     err.Error(),
+		ErrorType: string(errorTypeOf(err)),
+		Fatal:     true,
+		Err:       err,
+	})
+	if transfer.finish(&TransferAbortedEvent{Error: err.Error()}) {
+		transfer.teardown(err)
+	}
 }
 
 type TransferEvent interface{}
@@ -148,6 +526,10 @@ type TransferConnectingEvent struct {
 
 type TransferConnectedEvent struct {
 	URL string
+	// Security is how the connection to the server is protected.
+	Security SecurityLevel
+	// CertFingerprint is the SHA-256 of the server certificate, if any.
+	CertFingerprint string
 }
 
 type TransferErrorEvent struct {
@@ -155,6 +537,8 @@ type TransferErrorEvent struct {
 	Error     string
 	ErrorType string
 	Fatal     bool
+	// Err is the underlying error, if any.
+	Err error
 }
 
 type TransferRetryEvent struct {
@@ -162,185 +546,389 @@ type TransferRetryEvent struct {
 	Attempt     int
 	MaxAttempts int
 	Reason      string
+	// Delay is the backoff waited before the attempt.
+	Delay time.Duration
+}
+
+// TransferQueuedEvent is emitted when the bot put the request in its queue.
+// Total is 0 when the bot did not tell the queue length.
+type TransferQueuedEvent struct {
+	URL      string
+	Position int
+	Total    int
+}
+
+// TransferWaitingEvent is emitted when the scheduler holds the pack request
+// back. Limit is the limit reached: LimitGlobal, LimitNetwork or LimitBot.
+type TransferWaitingEvent struct {
+	URL   string
+	Limit string
+}
+
+// TransferSkippedEvent ends a transfer whose file was already downloaded,
+// see ExistsSkip.
+type TransferSkippedEvent struct {
+	FileName string
+	FileSize uint64
+	FilePath string
 }
 
 type TransferAbortedEvent struct {
 	Error string
+	// Cancelled is set when the transfer was stopped through Cancel.
+	Cancelled bool
 }
 
-const maxConnAttempts = 5
-
 type Transfer interface {
 	Start() error
 	PollEvents() chan TransferEvent
+	Cancel(ctx context.Context) error
 }
 
-type retryTransfer struct {
-	*XdccTransfer
-	conf Config
-}
-
-func (t *retryTransfer) Start() error {
-	// t.XdccTransfer is already initialized in NewTransfer
-	if err := t.XdccTransfer.Start(); err == nil {
-		return nil
-	}
-
-	t2 := newXdccTransfer(t.conf, true, true)
-	// Reuse event channel from first transfer
-	t2.events = t.XdccTransfer.events
-	t.XdccTransfer = t2
-	if err := t2.Start(); err == nil {
-		return nil
-	}
-
-	t3 := newXdccTransfer(t.conf, false, false)
-	// Reuse event channel
-	t3.events = t2.events
-	t.XdccTransfer = t3
-	return t3.Start()
+// pendingResume holds an offer for which a DCC RESUME was sent
+// and that is waiting for the bot to answer with DCC ACCEPT.
+type pendingResume struct {
+	send     *XdccSendRes
+	filePath string
+	offset   int
+	timer    *time.Timer
 }
 
-func (t *retryTransfer) PollEvents() chan TransferEvent {
-	return t.XdccTransfer.PollEvents()
+type XdccTransfer struct {
+	filePath       string
+	url            IRCFile
+	pool           *SessionPool
+	events         chan TransferEvent
+	startTime      time.Time
+	filenames      FilenamePolicy
+	passivePorts   PortRange
+	advertisedIP   net.IP
+	ackMode        AckMode
+	timeouts       Timeouts
+	stallPolicy    StallPolicy
+	retryPolicy    RetryPolicy
+	tlsPolicy      TLSPolicy
+	tlsModes       []TLSMode
+	sslOnly        bool
+	auth           Credentials
+	identity       Identity
+	scheduler      *Scheduler
+	rateLimiters   []*RateLimiter
+	checksumPolicy ChecksumPolicy
+	existsPolicy   ExistsPolicy
+	sizePolicy     SizePolicy
+	restarts       int
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// wg tracks the download goroutine
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	resume   *pendingResume
+	dataConn net.Conn
+	finished bool
+	session  *session
+	// started is set while the file is downloading
+	started bool
+	// requestSeq orders the pack requests sent over the session, it is 0
+	// until the pack is requested
+	requestSeq int
+
+	// botChecksums are the hashes published by the bot for the pack
+	botChecksums map[ChecksumAlgorithm]string
+
+	// releaseSlot gives back the slot granted by the scheduler
+	releaseSlot func()
+	waitingSlot bool
+
+	phase      Phase
+	phaseTimer *time.Timer
+
+	// lastFile is the file of the latest download, so that a restarted
+	// transfer resumes it even if it got a numeric suffix.
+	lastFile lastFile
 }
 
-type XdccTransfer struct {
-	filePath          string
-	url               IRCFile
-	conn              *irc.Conn
-	connAttempts      int
-	started           bool
-	events            chan TransferEvent
-	sslEnabled        bool
-	startTime         time.Time
-	sanitizeFilenames bool
+type lastFile struct {
+	offeredName string
+	filePath    string
 }
 
 type Config struct {
-	File              IRCFile
-	OutPath           string
-	SSLOnly           bool
-	SanitizeFilenames bool
+	File    IRCFile
+	OutPath string
+	// SSLOnly forbids unencrypted connections, whatever the TLS policy.
+	SSLOnly bool
+
+	// Filenames turns the name offered by the bot into the name of the
+	// file. Defaults to StandardFilenamePolicy with FilenameUnicodePreserving.
+	Filenames FilenamePolicy
+
+	// TLS selects which server certificates are accepted and whether
+	// plaintext connections are allowed. Defaults to TLSStrict.
+	TLS TLSPolicy
+
+	// Identity is the nick, ident, real name and CTCP version of the
+	// client, see DefaultIdentity.
+	Identity Identity
+
+	// Pool shares one IRC connection between the transfers created with it
+	// for the same network. Nil gives the transfer a connection of its own.
+	Pool *SessionPool
+
+	// Auth identifies the client to the network before the pack is
+	// requested. The zero value connects anonymously.
+	Auth Credentials
+
+	// Scheduler limits the number of active transfers; the pack is only
+	// requested once it grants a slot. Nil means no limit.
+	Scheduler *Scheduler
+
+	// RateLimit bounds the download speed of the transfer and GlobalRateLimit
+	// the total speed of the transfers sharing it. Their rate can be changed
+	// while downloading. Nil means unlimited.
+	RateLimit       *RateLimiter
+	GlobalRateLimit *RateLimiter
+
+	// OnExists tells what to do when the offered file is already in
+	// OutPath. Defaults to ExistsRename.
+	OnExists ExistsPolicy
+
+	// Size bounds the size of the offered file, which is also checked
+	// against the free space of OutPath.
+	Size SizePolicy
+
+	// Checksum configures the integrity check of downloaded files.
+	Checksum ChecksumPolicy
+
+	// PassivePorts restricts the ports we listen on for passive DCC offers.
+	// The zero value lets the system pick any free port.
+	PassivePorts PortRange
+	// AdvertisedIP is the address sent to bots in reply to passive offers.
+	// It must be set when running behind NAT; by default the address of
+	// the interface used to reach the IRC network is used.
+	AdvertisedIP net.IP
+
+	// AckMode selects how received data is acknowledged to the bot.
+	// Defaults to AckAuto.
+	AckMode AckMode
+
+	// Timeouts bounds each phase before the download starts.
+	// The zero value waits forever, see DefaultTimeouts.
+	Timeouts Timeouts
+
+	// Stall configures the detection of stuck downloads, which are then
+	// requested again and resumed. The zero value never restarts a download,
+	// see DefaultStallPolicy.
+	Stall StallPolicy
+
+	// Retry configures reconnections and restarts of interrupted downloads.
+	// The zero value never retries, see DefaultRetryPolicy.
+	Retry RetryPolicy
 }
 
 func NewTransfer(c Config) Transfer {
-	if c.SSLOnly {
-		return newXdccTransfer(c, true, false)
-	}
-
-	// Initialize with first transfer so events can be polled
-	return &retryTransfer{
-		XdccTransfer: newXdccTransfer(c, true, false),
-		conf:         c,
-	}
+	return newXdccTransfer(c)
 }
 
-func newXdccTransfer(c Config, enableSSL bool, skipCertificateCheck bool) *XdccTransfer {
-	rand.Seed(time.Now().UTC().UnixNano())
-	nick := IRCClientUserName + strconv.Itoa(int(rand.Uint32()))
-
-	file := c.File
+func newXdccTransfer(c Config) *XdccTransfer {
+	ctx, cancel := context.WithCancelCause(context.Background())
 
-	config := irc.NewConfig(nick)
-	config.SSL = enableSSL
-	config.SSLConfig = &tls.Config{ServerName: file.Network, InsecureSkipVerify: skipCertificateCheck}
-	config.Server = file.Network
-	config.NewNick = func(nick string) string {
-		return nick + "" + strconv.Itoa(int(rand.Uint32()))
+	pool := c.Pool
+	if pool == nil {
+		pool = NewSessionPool()
 	}
-	// Set proxy if configured
-	config.Proxy = proxy.ProxyURL()
-
-	conn := irc.Client(config)
 
 	t := &XdccTransfer{
-		conn:              conn,
-		url:               file,
-		filePath:          c.OutPath,
-		started:           false,
-		connAttempts:      0,
-		events:            make(chan TransferEvent, defaultEventChanSize),
-		sslEnabled:        enableSSL,
-		sanitizeFilenames: c.SanitizeFilenames,
+		ctx:            ctx,
+		cancel:         cancel,
+		pool:           pool,
+		url:            c.File,
+		filePath:       c.OutPath,
+		events:         make(chan TransferEvent, defaultEventChanSize),
+		filenames:      c.Filenames,
+		passivePorts:   c.PassivePorts,
+		advertisedIP:   c.AdvertisedIP,
+		ackMode:        c.AckMode,
+		timeouts:       c.Timeouts,
+		stallPolicy:    c.Stall,
+		retryPolicy:    c.Retry,
+		tlsPolicy:      c.TLS,
+		tlsModes:       c.TLS.modes(c.Retry.TLSModes),
+		sslOnly:        c.SSLOnly,
+		auth:           c.Auth,
+		identity:       c.Identity.withDefaults(),
+		scheduler:      c.Scheduler,
+		rateLimiters:   []*RateLimiter{c.RateLimit, c.GlobalRateLimit},
+		checksumPolicy: c.Checksum,
+		existsPolicy:   c.OnExists,
+		sizePolicy:     c.Size,
+		botChecksums:   map[ChecksumAlgorithm]string{},
+	}
+	// ircs URLs forbid plaintext like SSLOnly
+	if c.SSLOnly || c.File.SSL {
+		t.sslOnly = true
+		var modes []TLSMode
+		for _, mode := range t.tlsModes {
+			if mode != TLSModePlain {
+				modes = append(modes, mode)
+			}
+		}
+		t.tlsModes = c.TLS.modes(modes)
+	}
+	if t.filenames == nil {
+		t.filenames = StandardFilenamePolicy{Style: FilenameUnicodePreserving}
 	}
-	t.setupHandlers(file.Channel, file.UserName, file.Slot)
-
 	return t
 }
 
 func (transfer *XdccTransfer) send(req CTCPRequest) {
-	transfer.conn.Privmsg(transfer.url.UserName, req.String())
+	transfer.getSession().privmsg(transfer.url.UserName, req)
+}
+
+func (transfer *XdccTransfer) sendDCC(req CTCPRequest) {
+	transfer.getSession().sendDCC(transfer.url.UserName, req)
+}
+
+func (transfer *XdccTransfer) notifyConnected(security SecurityLevel, fingerprint string) {
+	transfer.notifyEvent(&TransferConnectedEvent{
+		URL:             transfer.url.String(),
+		Security:        security,
+		CertFingerprint: fingerprint,
+	})
 }
 
-func (transfer *XdccTransfer) setupHandlers(channel string, userName string, slot int) {
-	conn := transfer.conn
+// joinChannel is called once the session is registered to the network
+// and identified.
+func (transfer *XdccTransfer) joinChannel() {
+	if transfer.isStarted() {
+		return
+	}
+	transfer.enterPhase(PhaseJoin)
+	transfer.getSession().join(transfer)
+}
+
+// schedulePack requests the pack as soon as the scheduler allows it.
+func (transfer *XdccTransfer) schedulePack() {
+	if transfer.scheduler == nil {
+		transfer.requestPack()
+		return
+	}
+
+	transfer.mu.Lock()
+	held, waiting := transfer.releaseSlot != nil, transfer.waitingSlot
+	transfer.waitingSlot = !held
+	transfer.mu.Unlock()
 
-	// e.g. join channel on connect.
-	conn.HandleFunc(irc.CONNECTED,
-		func(conn *irc.Conn, line *irc.Line) {
-			transfer.connAttempts = 0
-			transfer.notifyEvent(&TransferConnectedEvent{
-				URL: transfer.url.String(),
+	if held {
+		transfer.requestPack()
+		return
+	}
+	transfer.enterPhase(PhaseWaiting)
+	if waiting {
+		return
+	}
+
+	go func() {
+		release, err := transfer.scheduler.acquire(transfer.ctx, transfer.url, func(limit string) {
+			transfer.notifyEvent(&TransferWaitingEvent{
+				URL:   transfer.url.String(),
+				Limit: limit,
 			})
-			conn.Join(channel)
 		})
 
-	conn.HandleFunc(irc.ERROR, func(conn *irc.Conn, line *irc.Line) {
-		transfer.notifyEvent(&TransferErrorEvent{
-			URL:       transfer.url.String(),
-			Error:     line.Text(),
-			ErrorType: "irc",
-			Fatal:     false,
-		})
-	})
+		transfer.mu.Lock()
+		transfer.waitingSlot = false
+		if err != nil {
+			transfer.mu.Unlock()
+			return
+		}
+		if transfer.finished {
+			transfer.mu.Unlock()
+			release()
+			return
+		}
+		transfer.releaseSlot = release
+		transfer.mu.Unlock()
 
-	// send xdcc send on successfull join
-	conn.HandleFunc(irc.JOIN,
-		func(conn *irc.Conn, line *irc.Line) {
-			if strings.EqualFold(line.Args[0], channel) && !transfer.started {
-				transfer.send(&XdccSendReq{Slot: slot})
-			}
-		})
+		transfer.requestPack()
+	}()
+}
 
-	conn.HandleFunc(irc.PRIVMSG, func(conn *irc.Conn, line *irc.Line) {})
+// requestPack asks the bot for the pack.
+func (transfer *XdccTransfer) requestPack() {
+	session := transfer.getSession()
+	session.nextRequest(transfer)
+	transfer.enterPhase(PhaseOffer)
+	if transfer.checksumPolicy.AskBot {
+		transfer.send(&XdccInfoReq{Slot: transfer.url.Slot})
+	}
+	transfer.send(&XdccSendReq{Slot: transfer.url.Slot})
+}
 
-	conn.HandleFunc(irc.CTCP,
-		func(conn *irc.Conn, line *irc.Line) {
-			res, err := parseCTCPRes(line.Text())
-			if err != nil {
-				fmt.Println(err.Error())
-				os.Exit(1) // TODO: correct clean up
-			}
-			transfer.handleCTCPRes(res)
-		})
+// awaitingOffer reports whether the pack was requested and the bot has
+// not sent it yet.
+func (transfer *XdccTransfer) awaitingOffer() bool {
+	phase := transfer.currentPhase()
+	return phase == PhaseOffer || phase == PhaseQueued
+}
+
+func (transfer *XdccTransfer) isStarted() bool {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.started
+}
 
-	conn.HandleFunc(irc.DISCONNECTED,
-		func(conn *irc.Conn, line *irc.Line) {
-			var err error = nil
+func (transfer *XdccTransfer) setStarted(started bool) {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	transfer.started = started
+}
 
-			if transfer.connAttempts < maxConnAttempts {
-				transfer.notifyEvent(&TransferRetryEvent{
-					URL:         transfer.url.String(),
-					Attempt:     transfer.connAttempts + 1,
-					MaxAttempts: maxConnAttempts,
-					Reason:      "disconnected",
-				})
-				time.Sleep(time.Second)
+// requested returns the number of the latest pack request, 0 if the pack
+// was not requested yet.
+func (transfer *XdccTransfer) requested() int {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.requestSeq
+}
 
-				err = conn.Connect()
-			}
+func (transfer *XdccTransfer) currentPhase() Phase {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.phase
+}
 
-			if (err != nil || transfer.connAttempts >= maxConnAttempts) && !transfer.started {
-				errMsg := "max connection attempts exceeded"
-				if err != nil {
-					errMsg = err.Error()
-				}
-				transfer.notifyEvent(&TransferAbortedEvent{Error: errMsg})
-			}
+func (transfer *XdccTransfer) lastOfferedName() string {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.lastFile.offeredName
+}
 
-			transfer.connAttempts++
+func (transfer *XdccTransfer) handleBotMessage(text string) {
+	switch msg := parseBotMessage(text).(type) {
+	case *botQueued:
+		transfer.enterQueuedPhase()
+		transfer.notifyEvent(&TransferQueuedEvent{
+			URL:      transfer.url.String(),
+			Position: msg.Position,
+			Total:    msg.Total,
 		})
+	case *botChecksum:
+		if transfer.awaitingOffer() {
+			transfer.mu.Lock()
+			transfer.botChecksums[msg.Algorithm] = msg.Value
+			transfer.mu.Unlock()
+		}
+	case *BotRejectionError:
+		err := newTransferError(ErrorTypeBot, msg)
+		if msg.Fatal() {
+			transfer.fail(err)
+		} else {
+			transfer.notifyError(err)
+		}
+	}
 }
 
 func (transfer *XdccTransfer) PollEvents() chan TransferEvent {
@@ -358,6 +946,19 @@ type TransferStartedEvent struct {
 	FileName string
 	FileSize uint64
 	FilePath string
+	// Encrypted is set when the file is received over TLS (SSEND).
+	Encrypted bool
+	// Security is how the DCC connection is protected.
+	Security SecurityLevel
+	// CertFingerprint is the SHA-256 of the bot certificate, if any.
+	CertFingerprint string
+}
+
+type TransferResumedEvent struct {
+	FileName string
+	FileSize uint64
+	FilePath string
+	Offset   uint64
 }
 
 type TransferCompletedEvent struct {
@@ -366,6 +967,12 @@ type TransferCompletedEvent struct {
 	FilePath string
 	Duration float64
 	AvgRate  float64
+	// Verification is the outcome of the integrity check of the file.
+	Verification Verification
+	// Encrypted is set when the file was received over TLS (SSEND).
+	Encrypted bool
+	// Security is how the DCC connection was protected.
+	Security SecurityLevel
 }
 
 func (transfer *XdccTransfer) notifyEvent(e TransferEvent) {
@@ -413,84 +1020,503 @@ func (monitor *SpeedMonitorReader) Read(buf []byte) (int, error) {
 	return n, err
 }
 
+// resumeAcceptTimeout is how long to wait for a DCC ACCEPT before
+// giving up on resuming and downloading the file from scratch.
+const resumeAcceptTimeout = 30 * time.Second
+
 func (transfer *XdccTransfer) handleXdccSendRes(send *XdccSendRes) {
-	go func() {
-		// Use proxy-aware dialer for file transfer
-		address := fmt.Sprintf("%s:%d", send.IP.String(), send.Port)
-		conn, err := proxy.DialContext(context.Background(), "tcp", address)
+	transfer.leavePhases()
+
+	if err := transfer.sizePolicy.check(int64(send.FileSize)); err != nil {
+		transfer.fail(newTransferError(ErrorTypeOffer, err))
+		return
+	}
+
+	// names come from the bot, they must not escape the output folder
+	filename := safeFilename(transfer.filenames.Sanitize(send.FileName), maxFilenameBytes)
+
+	filePath := filepath.Join(transfer.filePath, filename)
+
+	transfer.mu.Lock()
+	restarted := transfer.lastFile.offeredName == send.FileName
+	if restarted {
+		filePath = transfer.lastFile.filePath
+	}
+	transfer.mu.Unlock()
+
+	if !restarted {
+		target, skip, err := transfer.existsPolicy.target(filePath, send.FileSize)
 		if err != nil {
-			log.Fatalf("unable to reach host %s:%d", send.IP.String(), send.Port)
+			transfer.fail(newTransferError(ErrorTypeFile, err))
+			return
+		}
+		if skip {
+			if transfer.finish(&TransferSkippedEvent{
+				FileName: filepath.Base(filePath),
+				FileSize: uint64(send.FileSize),
+				FilePath: filePath,
+			}) {
+				transfer.teardown(nil)
+			}
 			return
 		}
+		filePath = target
+	}
 
-		filename := send.FileName
-		if transfer.sanitizeFilenames {
-			filename = SanitizeFilename(filename)
+	// A part file is what is left of an interrupted transfer: ask the bot
+	// to continue from where it stopped.
+	offset := 0
+	if info, err := os.Stat(PartFilePath(filePath)); err == nil && info.Mode().IsRegular() &&
+		info.Size() > 0 && info.Size() < int64(send.FileSize) {
+		offset = int(info.Size())
+	}
+
+	if err := checkFreeSpace(filepath.Dir(filePath), int64(send.FileSize-offset)); err != nil {
+		transfer.fail(newTransferError(ErrorTypeOffer, err))
+		return
+	}
+
+	if offset > 0 {
+		transfer.requestResume(send, filePath, offset)
+		return
+	}
+	transfer.download(send, filePath, 0)
+}
+
+func (transfer *XdccTransfer) requestResume(send *XdccSendRes, filePath string, offset int) {
+	pending := &pendingResume{
+		send:     send,
+		filePath: filePath,
+		offset:   offset,
+	}
+
+	transfer.mu.Lock()
+	transfer.resume = pending
+	transfer.mu.Unlock()
+
+	pending.timer = time.AfterFunc(resumeAcceptTimeout, func() {
+		if transfer.cancelled() {
+			return
+		}
+		if transfer.takeResume(send.Port, send.Token) != nil {
+			transfer.download(send, filePath, 0)
 		}
+	})
 
-		filePath := filepath.Join(transfer.filePath, filename)
-		filePath = GetUniqueFilePath(filePath)
-		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
-		fileWriter := bufio.NewWriter(file)
+	transfer.sendDCC(&DccResumeReq{
+		FileName: send.FileName,
+		Port:     send.Port,
+		Position: offset,
+		Token:    send.Token,
+	})
+}
+
+// takeResume returns and clears the pending resume for the given port
+// (and token, for passive offers), if any.
+func (transfer *XdccTransfer) takeResume(port int, token string) *pendingResume {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
 
+	pending := transfer.resume
+	if pending == nil || pending.send.Port != port || pending.send.Token != token {
+		return nil
+	}
+	transfer.resume = nil
+	return pending
+}
+
+func (transfer *XdccTransfer) handleXdccAcceptRes(accept *XdccAcceptRes) {
+	pending := transfer.takeResume(accept.Port, accept.Token)
+	if pending == nil {
+		return
+	}
+	pending.timer.Stop()
+
+	// bots may accept an earlier position than the one we asked for, the
+	// part file is then truncated; a later one would leave a hole
+	if accept.Position > pending.offset {
+		transfer.fail(newTransferError(ErrorTypeOffer, fmt.Errorf("bot resumes %s at %d, past the %d bytes received",
+			pending.send.FileName, accept.Position, pending.offset)))
+		return
+	}
+	transfer.download(pending.send, pending.filePath, accept.Position)
+}
+
+func (transfer *XdccTransfer) download(send *XdccSendRes, filePath string, offset int) {
+	transfer.wg.Add(1)
+	go func() {
+		defer transfer.wg.Done()
+
+		conn, err := transfer.openDataConn(send)
+		if err != nil {
+			transfer.fail(err)
+			return
+		}
+		security, fingerprint := SecurityPlaintext, ""
+		if send.Secure {
+			conn, security, fingerprint, err = transfer.secureDataConn(conn, send)
+			if err != nil {
+				transfer.fail(err)
+				return
+			}
+		}
+		defer conn.Close()
+
+		if !transfer.setDataConn(conn) {
+			return
+		}
+
+		transfer.mu.Lock()
+		transfer.lastFile = lastFile{offeredName: send.FileName, filePath: filePath}
+		transfer.mu.Unlock()
+
+		// the file keeps the part suffix until it is complete
+		partPath := PartFilePath(filePath)
+		flags := os.O_CREATE | os.O_WRONLY
+		if offset > 0 {
+			flags |= os.O_APPEND
+		} else {
+			flags |= os.O_TRUNC
+		}
+		file, err := os.OpenFile(partPath, flags, 0644)
 		if err != nil {
-			log.Fatal(err.Error())
+			transfer.fail(newTransferError(ErrorTypeFile, err))
 			return
 		}
+		defer file.Close()
+
+		if offset > 0 {
+			// discard anything past the position accepted by the bot
+			if err := file.Truncate(int64(offset)); err != nil {
+				transfer.fail(newTransferError(ErrorTypeFile, err))
+				return
+			}
+		}
+		if transfer.sizePolicy.Preallocate && send.FileSize > 0 {
+			// filesystems that cannot preallocate are written as usual
+			if err := preallocate(file, int64(send.FileSize)); isNoSpace(err) {
+				transfer.fail(newTransferError(ErrorTypeOffer, &OfferRejectedError{
+					Reason:   OfferNoSpace,
+					FileSize: int64(send.FileSize - offset),
+				}))
+				return
+			}
+		}
+		fileWriter := bufio.NewWriter(file)
+
+		checksums := newChecksummer()
+		if offset > 0 {
+			if err := checksums.readPrefix(partPath, int64(offset)); err != nil {
+				transfer.fail(newTransferError(ErrorTypeFile, err))
+				return
+			}
+		}
 
 		// Extract the actual filename (may have suffix added)
 		actualFilename := filepath.Base(filePath)
 
 		downloadStartTime := time.Now()
 		transfer.notifyEvent(&TransferStartedEvent{
-			FileName: actualFilename,
-			FileSize: uint64(send.FileSize),
-			FilePath: filePath,
+			FileName:        actualFilename,
+			FileSize:        uint64(send.FileSize),
+			FilePath:        filePath,
+			Encrypted:       send.Secure,
+			Security:        security,
+			CertFingerprint: fingerprint,
 		})
-		transfer.started = true
+		if offset > 0 {
+			transfer.notifyEvent(&TransferResumedEvent{
+				FileName: actualFilename,
+				FileSize: uint64(send.FileSize),
+				FilePath: filePath,
+				Offset:   uint64(offset),
+			})
+		}
+		transfer.setStarted(true)
 
-		reader := NewSpeedMonitorReader(conn, func(dowloadedAmount int, speed float64) {
+		limitedConn := newRateLimitedReader(transfer.ctx, conn, transfer.rateLimiters...)
+		reader := NewSpeedMonitorReader(limitedConn, func(dowloadedAmount int, speed float64) {
 			transfer.notifyEvent(&TransferProgessEvent{
 				TransferRate:  float32(speed),
-				TransferBytes: uint64(dowloadedAmount),
+				TransferBytes: uint64(offset + dowloadedAmount),
 			})
 		})
 
+		ackMode := transfer.ackMode.resolve(send)
+		stall := newStallDetector(transfer.stallPolicy)
+
+		// without an announced size, the file ends when the bot closes
+		// the connection
+		unknownSize := send.FileSize == 0
+
 		// download loop
-		downloadedBytesTotal := 0
+		downloadedBytesTotal := offset
 		buf := make([]byte, downloadBufSize)
-		for downloadedBytesTotal < send.FileSize {
+		for unknownSize || downloadedBytesTotal < send.FileSize {
+			if transfer.stallPolicy.Timeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(transfer.stallPolicy.Timeout))
+			}
 			n, err := reader.Read(buf)
 
 			if err != nil {
-				log.Fatal(err.Error())
+				if unknownSize && errors.Is(err, io.EOF) {
+					break
+				}
+				fileWriter.Flush()
+				if isTimeout(err) {
+					transfer.restart("stalled", newTransferError(ErrorTypeNetwork, ErrTransferStalled))
+					return
+				}
+				transfer.restart("interrupted", newTransferError(ErrorTypeNetwork, err))
 				return
 			}
 
 			if _, err := fileWriter.Write(buf[:n]); err != nil {
-				log.Fatal(err.Error())
+				transfer.fail(newTransferError(ErrorTypeFile, err))
 				return
 			}
+			checksums.Write(buf[:n])
 
 			downloadedBytesTotal += n
+
+			if maxSize := transfer.sizePolicy.MaxSize; unknownSize && maxSize > 0 && int64(downloadedBytesTotal) > maxSize {
+				transfer.fail(newTransferError(ErrorTypeOffer, &OfferRejectedError{
+					Reason:   OfferTooLarge,
+					FileSize: int64(downloadedBytesTotal),
+					Limit:    maxSize,
+				}))
+				return
+			}
+
+			if stall.update(n) {
+				fileWriter.Flush()
+				transfer.restart("stalled", newTransferError(ErrorTypeNetwork, ErrTransferTooSlow))
+				return
+			}
+
+			// bots often close the socket right after the last packet,
+			// so a failure to acknowledge it is not an error
+			err = transfer.acknowledge(conn, ackMode, uint64(downloadedBytesTotal))
+			if err != nil && !unknownSize && downloadedBytesTotal < send.FileSize {
+				fileWriter.Flush()
+				if isTimeout(err) {
+					transfer.restart("stalled", newTransferError(ErrorTypeNetwork, ErrTransferStalled))
+					return
+				}
+				transfer.fail(newTransferError(ErrorTypeNetwork, err))
+				return
+			}
+		}
+
+		if err := fileWriter.Flush(); err != nil {
+			transfer.fail(newTransferError(ErrorTypeFile, err))
+			return
+		}
+
+		verification := checksums.verify(transfer.expectedChecksums(send.FileName))
+		if verification.Status == VerificationMismatch && transfer.checksumPolicy.FailOnMismatch {
+			transfer.fail(newTransferError(ErrorTypeChecksum, &ChecksumMismatchError{
+				FileName:  actualFilename,
+				Algorithm: verification.Algorithm,
+				Expected:  verification.Expected,
+				Actual:    verification.Actual,
+			}))
+			return
+		}
+
+		// the final name is only given to data that reached the disk
+		if err := file.Sync(); err != nil {
+			transfer.fail(newTransferError(ErrorTypeFile, err))
+			return
+		}
+		if err := file.Close(); err != nil {
+			transfer.fail(newTransferError(ErrorTypeFile, err))
+			return
+		}
+		if err := os.Rename(partPath, filePath); err != nil {
+			transfer.fail(newTransferError(ErrorTypeFile, err))
+			return
 		}
-		fileWriter.Flush()
 
 		duration := time.Since(downloadStartTime).Seconds()
-		avgRate := float64(send.FileSize) / duration
-		transfer.notifyEvent(&TransferCompletedEvent{
-			FileName: actualFilename,
-			FileSize: uint64(send.FileSize),
-			FilePath: filePath,
-			Duration: duration,
-			AvgRate:  avgRate,
-		})
+		avgRate := float64(downloadedBytesTotal-offset) / duration
+		if transfer.finish(&TransferCompletedEvent{
+			FileName:     actualFilename,
+			FileSize:     uint64(downloadedBytesTotal),
+			FilePath:     filePath,
+			Duration:     duration,
+			AvgRate:      avgRate,
+			Verification: verification,
+			Encrypted:    send.Secure,
+			Security:     security,
+		}) {
+			transfer.teardown(nil)
+		}
 	}()
 }
 
-func (transfer *XdccTransfer) handleCTCPRes(resp CTCPResponse) {
-	switch r := resp.(type) {
-	case *XdccSendRes:
-		transfer.handleXdccSendRes(r)
+// expectedChecksums returns the hashes the file is checked against: those
+// published by the bot and the CRC32 tag of the offered name.
+func (transfer *XdccTransfer) expectedChecksums(offeredName string) map[ChecksumAlgorithm]string {
+	expected := map[ChecksumAlgorithm]string{}
+	if crc, ok := filenameChecksum(offeredName); ok {
+		expected[ChecksumCRC32] = crc
+	}
+
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	for algorithm, value := range transfer.botChecksums {
+		expected[algorithm] = value
+	}
+	return expected
+}
+
+// restart drops the current DCC connection and requests the pack again
+// after the retry backoff, so that the partial file gets resumed.
+// The transfer fails with err once the retry policy is exhausted.
+func (transfer *XdccTransfer) restart(reason string, err error) {
+	if transfer.cancelled() || transfer.isFinished() {
+		return
+	}
+
+	transfer.mu.Lock()
+	if transfer.dataConn != nil {
+		transfer.dataConn.Close()
+		transfer.dataConn = nil
+	}
+	transfer.restarts++
+	retry := transfer.restarts
+	transfer.mu.Unlock()
+
+	policy := transfer.retryPolicy
+	if retry >= policy.maxAttempts() || !policy.retryable(err) {
+		transfer.fail(err)
+		return
+	}
+
+	delay := policy.Backoff(retry)
+	transfer.notifyEvent(&TransferRetryEvent{
+		URL:         transfer.url.String(),
+		Attempt:     retry + 1,
+		MaxAttempts: policy.maxAttempts(),
+		Reason:      reason,
+		Delay:       delay,
+	})
+
+	transfer.setStarted(false)
+	if !sleepContext(transfer.ctx, delay) {
+		return
+	}
+	transfer.requestPack()
+}
+
+// acknowledge tells the bot how much was received. A bot that stops
+// reading the acknowledgements fills the TCP window and blocks the write,
+// which then times out like a stalled read.
+func (transfer *XdccTransfer) acknowledge(conn net.Conn, mode AckMode, received uint64) error {
+	if transfer.stallPolicy.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(transfer.stallPolicy.Timeout))
+	}
+	return mode.writeAck(conn, received)
+}
+
+// setDataConn records the DCC socket so that it can be closed on
+// cancellation. It fails if the transfer was cancelled in the meantime.
+func (transfer *XdccTransfer) setDataConn(conn net.Conn) bool {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+
+	if transfer.cancelled() {
+		return false
+	}
+	transfer.dataConn = conn
+	return true
+}
+
+// openDataConn connects to the bot for an active offer, or waits for the
+// bot to connect to us for a passive one.
+func (transfer *XdccTransfer) openDataConn(send *XdccSendRes) (net.Conn, error) {
+	if !send.IsPassive() {
+		// Use proxy-aware dialer for file transfer
+		conn, err := proxy.DialContext(transfer.ctx, "tcp", send.Address())
+		if err != nil {
+			return nil, newTransferError(ErrorTypeNetwork, fmt.Errorf("unable to reach host %s: %w", send.Address(), err))
+		}
+		return conn, nil
+	}
+
+	ip := transfer.advertisedIP
+	if ip == nil {
+		var err error
+		host, _ := splitNetwork(transfer.url.Network)
+		if ip, err = outboundIP(host); err != nil {
+			return nil, newTransferError(ErrorTypeNetwork, err)
+		}
+	}
+
+	listener, err := transfer.passivePorts.Listen()
+	if err != nil {
+		return nil, newTransferError(ErrorTypeNetwork, err)
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(transfer.ctx, func() { listener.Close() })
+	defer stop()
+
+	transfer.sendDCC(&XdccPassiveSendReq{
+		FileName: send.FileName,
+		IP:       ip,
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		FileSize: send.FileSize,
+		Token:    send.Token,
+	})
+	conn, err := acceptTimeout(listener, passiveAcceptTimeout)
+	if err != nil {
+		return nil, newTransferError(ErrorTypeNetwork, err)
+	}
+	return conn, nil
+}
+
+// dccHandshakeTimeout bounds the TLS handshake of a SSEND offer.
+const dccHandshakeTimeout = time.Minute
+
+// secureDataConn wraps the connection of a SSEND offer in TLS. The side
+// that opened the connection is the TLS client: us for active offers,
+// the bot for passive ones. conn is closed if the handshake fails.
+func (transfer *XdccTransfer) secureDataConn(conn net.Conn, send *XdccSendRes) (net.Conn, SecurityLevel, string, error) {
+	host := send.Host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+
+	var (
+		level       SecurityLevel
+		fingerprint string
+	)
+	// bot certificates are pinned apart from the one of their network
+	network, _ := splitNetwork(transfer.url.Network)
+	pin := network + "/" + transfer.url.UserName
+	config := transfer.tlsPolicy.dccTLSConfig(host, pin, send.IsPassive(), func(l SecurityLevel, f string) {
+		level, fingerprint = l, f
+	})
+
+	var tlsConn *tls.Conn
+	if send.IsPassive() {
+		cert, err := dccCertificate()
+		if err != nil {
+			conn.Close()
+			return nil, "", "", newTransferError(ErrorTypeSSL, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+		tlsConn = tls.Server(conn, config)
+	} else {
+		tlsConn = tls.Client(conn, config)
+	}
+
+	ctx, cancel := context.WithTimeout(transfer.ctx, dccHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, "", "", classifyConnectError(err)
 	}
+	return tlsConn, level, fingerprint, nil
 }
@@ -0,0 +1,169 @@
+package xdcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeBot serves data to the first connection on a loopback port, like a
+// bot after an active offer, and reads the acknowledgements up to total.
+func fakeBot(t *testing.T, data []byte, total int) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write(data)
+		var ack [4]byte
+		for {
+			if _, err := io.ReadFull(conn, ack[:]); err != nil {
+				return
+			}
+			if binary.BigEndian.Uint32(ack[:]) >= uint32(total) {
+				return
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitFinished returns the terminal event of the transfer.
+func waitFinished(t *testing.T, transfer *XdccTransfer) TransferEvent {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-transfer.PollEvents():
+			switch e.(type) {
+			case *TransferCompletedEvent, *TransferAbortedEvent, *TransferSkippedEvent:
+				return e
+			}
+		case <-timeout:
+			t.Fatal("transfer did not finish")
+			return nil
+		}
+	}
+}
+
+// newResumingTransfer returns a transfer that sent a DCC RESUME for the
+// offer, part is what the part file holds.
+func newResumingTransfer(t *testing.T, send *XdccSendRes, part []byte) (*XdccTransfer, string) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, send.FileName)
+	if err := os.WriteFile(PartFilePath(filePath), part, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := newXdccTransfer(Config{OutPath: dir})
+	transfer.resume = &pendingResume{
+		send:     send,
+		filePath: filePath,
+		offset:   len(part),
+		timer:    time.NewTimer(time.Hour),
+	}
+	return transfer, filePath
+}
+
+func TestTakeResume(t *testing.T) {
+	tests := []struct {
+		name  string
+		send  XdccSendRes
+		port  int
+		token string
+		match bool
+	}{
+		{"same port", XdccSendRes{Port: 5000}, 5000, "", true},
+		{"other port", XdccSendRes{Port: 5000}, 5001, "", false},
+		{"same token", XdccSendRes{Token: "42"}, 0, "42", true},
+		{"other token", XdccSendRes{Token: "42"}, 0, "43", false},
+		{"missing token", XdccSendRes{Token: "42"}, 0, "", false},
+	}
+
+	for _, test := range tests {
+		transfer := newXdccTransfer(Config{})
+		transfer.resume = &pendingResume{send: &test.send, offset: 10}
+
+		pending := transfer.takeResume(test.port, test.token)
+		if (pending != nil) != test.match {
+			t.Errorf("%s: got %v, want match %v", test.name, pending, test.match)
+		}
+		if (transfer.resume == nil) != test.match {
+			t.Errorf("%s: pending resume should be kept unless matched", test.name)
+		}
+	}
+}
+
+func TestHandleXdccAcceptRes(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 20)
+
+	t.Run("requested offset", func(t *testing.T) {
+		send := &XdccSendRes{FileName: "file.bin", IP: net.IPv4(127, 0, 0, 1), FileSize: len(data)}
+		send.Port = fakeBot(t, data[100:], len(data))
+		transfer, filePath := newResumingTransfer(t, send, data[:100])
+
+		transfer.handleXdccAcceptRes(&XdccAcceptRes{FileName: send.FileName, Port: send.Port, Position: 100})
+		if e, ok := waitFinished(t, transfer).(*TransferCompletedEvent); !ok {
+			t.Fatalf("got %+v, want a completed transfer", e)
+		}
+		if got, _ := os.ReadFile(filePath); !bytes.Equal(got, data) {
+			t.Errorf("got %q, want %q", got, data)
+		}
+	})
+
+	t.Run("earlier offset truncates the part file", func(t *testing.T) {
+		send := &XdccSendRes{FileName: "file.bin", IP: net.IPv4(127, 0, 0, 1), FileSize: len(data)}
+		send.Port = fakeBot(t, data[60:], len(data))
+		part := append(append([]byte{}, data[:60]...), bytes.Repeat([]byte("x"), 40)...)
+		transfer, filePath := newResumingTransfer(t, send, part)
+
+		transfer.handleXdccAcceptRes(&XdccAcceptRes{FileName: send.FileName, Port: send.Port, Position: 60})
+		if e, ok := waitFinished(t, transfer).(*TransferCompletedEvent); !ok {
+			t.Fatalf("got %+v, want a completed transfer", e)
+		}
+		if got, _ := os.ReadFile(filePath); !bytes.Equal(got, data) {
+			t.Errorf("got %q, want %q", got, data)
+		}
+	})
+
+	t.Run("later offset is rejected", func(t *testing.T) {
+		send := &XdccSendRes{FileName: "file.bin", IP: net.IPv4(127, 0, 0, 1), Port: 5000, FileSize: len(data)}
+		transfer, filePath := newResumingTransfer(t, send, data[:100])
+
+		transfer.handleXdccAcceptRes(&XdccAcceptRes{FileName: send.FileName, Port: send.Port, Position: 120})
+		if e, ok := waitFinished(t, transfer).(*TransferAbortedEvent); !ok {
+			t.Fatalf("got %+v, want an aborted transfer", e)
+		}
+		if got, _ := os.ReadFile(PartFilePath(filePath)); !bytes.Equal(got, data[:100]) {
+			t.Errorf("part file changed to %q", got)
+		}
+	})
+
+	t.Run("other offer is ignored", func(t *testing.T) {
+		send := &XdccSendRes{FileName: "file.bin", IP: net.IPv4(127, 0, 0, 1), Port: 5000, FileSize: len(data)}
+		transfer, _ := newResumingTransfer(t, send, data[:100])
+		defer transfer.resume.timer.Stop()
+
+		transfer.handleXdccAcceptRes(&XdccAcceptRes{FileName: send.FileName, Port: 5001, Position: 100})
+		if transfer.resume == nil {
+			t.Error("resume of the offer was dropped")
+		}
+		select {
+		case e := <-transfer.PollEvents():
+			t.Errorf("unexpected event %+v", e)
+		default:
+		}
+	})
+}